@@ -0,0 +1,53 @@
+// Copyright 2018 Zurich University of Applied Sciences.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+/*
+
+Gencond generates the tracebox to PTO condition mapping from the decision
+table in a Go source file, normally pto3-trace.go.
+
+The decision table is part of a comment and looks like this:
+
+	Count     | Name                           | Decision
+	==========+================================+=====================
+	9171447313 IP::Checksum                    | Ignore
+	1279130958 IP::DiffServicesCP              | NEW dscp.0.changed
+	 326560370 TCP::O::MSS                     | tcp.option.mss.changed
+	       864 TCP::O::Bogus                   |
+
+The table starts after the line of "=" and "+" characters and ends at
+the first empty line. A decision of "Ignore" means that the name is
+ignored; an empty decision means that nobody has decided yet; anything
+else is the PTO condition to which the name is mapped, optionally
+preceded by "NEW" if the condition is not yet known to the PTO.
+
+Unlike a regular-expression scan, gencond is strict. It fails if a row
+in the table is malformed, if a name appears twice, if a name is not a
+tracebox name, or if a condition does not follow the PTO naming grammar
+of lowercase, dot-separated components.
+
+The output is a Go source file with the variables tbToCond (name to
+condition), tbNewConds (conditions marked NEW), tbIgnored, and
+tbUndecided, all sorted so that the output is deterministic. It also has
+tbAdded and tbStripped, the names that the tbAddToCond and tbDelToCond
+maps in the input map to conditions, so that tb-cond can check additions
+and deletions without importing pto3-trace. It is meant to be used with
+go generate:
+
+	//go:generate go run ../pto3-trace-gencond -o conditions.go pto3-trace.go
+
+With -counts, gencond also reads the JSON output of tb-cond (tb-cond
+-format=json) and logs a row for every name that tb-cond counted but that
+is not in the decision table, ready to be pasted into the table.
+
+Usage:
+
+	pto3-trace-gencond [-package name] [-o file] [-json file] [-counts file] input
+
+	-package name	package of the generated file (default main)
+	-o file		write Go source to file (default stdout)
+	-json file	also write the decisions as JSON to file
+	-counts file	log the names in the tb-cond JSON output in file that are not in the table
+*/
+package main
@@ -0,0 +1,364 @@
+// Copyright 2018 Zurich University of Applied Sciences.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/json-iterator/go"
+	trace "github.com/mami-project/pto3-trace"
+)
+
+var (
+	pkg     = flag.String("package", "main", "package of the generated file")
+	outName = flag.String("o", "", "output file for Go source (default stdout)")
+	jsName  = flag.String("json", "", "output file for decisions as JSON")
+	counts  = flag.String("counts", "", "tb-cond JSON output to check the table against")
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "%s, git ref %s\n", os.Args[0], trace.CommitRef)
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] input\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+// decisions holds the contents of the decision table.
+type decisions struct {
+	Mapped    map[string]string `json:"mapped"`
+	New       []string          `json:"new"`
+	Ignored   []string          `json:"ignored"`
+	Undecided []string          `json:"undecided"`
+	Added     []string          `json:"added"`
+	Stripped  []string          `json:"stripped"`
+}
+
+var (
+	tableStartRe = regexp.MustCompile(`^\s*=+(\+=+)+\s*$`)
+	rowRe        = regexp.MustCompile(`^\s*(\d+) (\S+)\s+\|(.*)$`)
+	nameRe       = regexp.MustCompile(`^(IP|IPv6|TCP)::\S+$`)
+	conditionRe  = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*(\.[a-z0-9][a-z0-9-]*)+$`)
+)
+
+// parseDecisions reads the decision table from in.
+func parseDecisions(in io.Reader) (*decisions, error) {
+	ret := &decisions{Mapped: make(map[string]string)}
+	seen := make(map[string]int)
+	newConds := make(map[string]bool)
+
+	scanner := bufio.NewScanner(in)
+	var lineno int
+	var inTable, found bool
+
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+
+		if !inTable {
+			if tableStartRe.MatchString(line) {
+				if found {
+					return nil, fmt.Errorf("line %d: second decision table", lineno)
+				}
+				inTable = true
+				found = true
+			}
+			continue
+		}
+
+		if strings.TrimSpace(line) == "" {
+			inTable = false
+			continue
+		}
+
+		matches := rowRe.FindStringSubmatch(line)
+		if matches == nil {
+			return nil, fmt.Errorf("line %d: malformed row \"%s\"", lineno, line)
+		}
+
+		name := matches[2]
+		decision := strings.Fields(matches[3])
+
+		if !nameRe.MatchString(name) {
+			return nil, fmt.Errorf("line %d: \"%s\" is not a tracebox name", lineno, name)
+		}
+		if prev, ok := seen[name]; ok {
+			return nil, fmt.Errorf("line %d: duplicate name %s (first seen on line %d)", lineno, name, prev)
+		}
+		seen[name] = lineno
+
+		isNew := len(decision) > 0 && decision[0] == "NEW"
+		if isNew {
+			decision = decision[1:]
+			if len(decision) == 0 {
+				return nil, fmt.Errorf("line %d: NEW without condition for %s", lineno, name)
+			}
+		}
+
+		switch {
+		case len(decision) == 0:
+			ret.Undecided = append(ret.Undecided, name)
+		case len(decision) > 1:
+			return nil, fmt.Errorf("line %d: malformed decision \"%s\"", lineno, strings.Join(decision, " "))
+		case decision[0] == "Ignore":
+			if isNew {
+				return nil, fmt.Errorf("line %d: NEW can't be ignored", lineno)
+			}
+			ret.Ignored = append(ret.Ignored, name)
+		case !conditionRe.MatchString(decision[0]):
+			return nil, fmt.Errorf("line %d: \"%s\" is not a valid PTO condition", lineno, decision[0])
+		default:
+			ret.Mapped[name] = decision[0]
+			if isNew {
+				newConds[decision[0]] = true
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, fmt.Errorf("no decision table found")
+	}
+
+	for c := range newConds {
+		ret.New = append(ret.New, c)
+	}
+
+	sort.Strings(ret.New)
+	sort.Strings(ret.Ignored)
+	sort.Strings(ret.Undecided)
+
+	return ret, nil
+}
+
+// mapKeys returns the sorted keys of the map literal assigned to the
+// package-level variable varName in the Go source src.
+func mapKeys(src []byte, input string, varName string) ([]string, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), input, src, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			vs := spec.(*ast.ValueSpec)
+			for i, ident := range vs.Names {
+				if ident.Name != varName || i >= len(vs.Values) {
+					continue
+				}
+				lit, ok := vs.Values[i].(*ast.CompositeLit)
+				if !ok {
+					return nil, fmt.Errorf("%s is not a map literal", varName)
+				}
+				return literalKeys(lit, varName)
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no variable %s", varName)
+}
+
+// literalKeys returns the sorted string keys of the map literal lit.
+func literalKeys(lit *ast.CompositeLit, varName string) ([]string, error) {
+	ret := make([]string, 0, len(lit.Elts))
+	for _, e := range lit.Elts {
+		kv, ok := e.(*ast.KeyValueExpr)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a map literal", varName)
+		}
+		key, ok := kv.Key.(*ast.BasicLit)
+		if !ok || key.Kind != token.STRING {
+			return nil, fmt.Errorf("%s has a key that isn't a string literal", varName)
+		}
+		name, err := strconv.Unquote(key.Value)
+		if err != nil {
+			return nil, err
+		}
+		if !nameRe.MatchString(name) {
+			return nil, fmt.Errorf("%s: \"%s\" is not a tracebox name", varName, name)
+		}
+		ret = append(ret, name)
+	}
+
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func writeStrings(out io.Writer, varName string, comment string, s []string) {
+	fmt.Fprintf(out, "\n// %s %s\n", varName, comment)
+	fmt.Fprintf(out, "var %s = []string{\n", varName)
+	for _, v := range s {
+		fmt.Fprintf(out, "%q,\n", v)
+	}
+	fmt.Fprintf(out, "}\n")
+}
+
+// generate returns formatted Go source for d.
+func generate(d *decisions, pkg string, input string) ([]byte, error) {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "// Code generated by pto3-trace-gencond from %s. DO NOT EDIT.\n\n", input)
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+
+	names := make([]string, 0, len(d.Mapped))
+	for k := range d.Mapped {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(&b, "// tbToCond maps tracebox names to PTO conditions.\n")
+	fmt.Fprintf(&b, "var tbToCond = map[string]string{\n")
+	for _, k := range names {
+		fmt.Fprintf(&b, "%q: %q,\n", k, d.Mapped[k])
+	}
+	fmt.Fprintf(&b, "}\n")
+
+	writeStrings(&b, "tbNewConds", "lists the conditions that are marked NEW.", d.New)
+	writeStrings(&b, "tbIgnored", "lists the tracebox names that are ignored.", d.Ignored)
+	writeStrings(&b, "tbUndecided", "lists the tracebox names without a decision.", d.Undecided)
+	writeStrings(&b, "tbAdded", "lists the tracebox names in tbAddToCond.", d.Added)
+	writeStrings(&b, "tbStripped", "lists the tracebox names in tbDelToCond.", d.Stripped)
+
+	return format.Source(b.Bytes())
+}
+
+// nameCount is a count from the JSON output of tb-cond.
+type nameCount struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+// readCounts reads the counts from the JSON output of tb-cond.
+func readCounts(in io.Reader) ([]nameCount, error) {
+	var report struct {
+		Conditions []nameCount `json:"conditions"`
+	}
+
+	if err := jsoniter.NewDecoder(in).Decode(&report); err != nil {
+		return nil, err
+	}
+
+	return report.Conditions, nil
+}
+
+// missingNames returns the counts of the names that aren't in the decision
+// table, in the order in which they appear in counts.
+func missingNames(d *decisions, counts []nameCount) []nameCount {
+	known := make(map[string]bool)
+	for k := range d.Mapped {
+		known[k] = true
+	}
+	for _, k := range d.Ignored {
+		known[k] = true
+	}
+	for _, k := range d.Undecided {
+		known[k] = true
+	}
+
+	var ret []nameCount
+	for _, c := range counts {
+		if !known[c.Name] {
+			ret = append(ret, c)
+		}
+	}
+
+	return ret
+}
+
+// checkCounts logs a table row, ready to paste, for every name that tb-cond
+// counted but that isn't in the decision table.
+func checkCounts(d *decisions, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("can't open \"%s\": %v", path, err)
+	}
+
+	counts, err := readCounts(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+
+	for _, c := range missingNames(d, counts) {
+		log.Printf("not in the decision table: %10d %-31s |", c.Count, c.Name)
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	input := flag.Arg(0)
+
+	in, err := ioutil.ReadFile(input)
+	if err != nil {
+		log.Fatalf("can't read \"%s\": %v", input, err)
+	}
+
+	d, err := parseDecisions(bytes.NewReader(in))
+	if err != nil {
+		log.Fatalf("%s: %v", input, err)
+	}
+
+	if d.Added, err = mapKeys(in, input, "tbAddToCond"); err != nil {
+		log.Fatalf("%s: %v", input, err)
+	}
+	if d.Stripped, err = mapKeys(in, input, "tbDelToCond"); err != nil {
+		log.Fatalf("%s: %v", input, err)
+	}
+
+	if *counts != "" {
+		checkCounts(d, *counts)
+	}
+
+	src, err := generate(d, *pkg, input)
+	if err != nil {
+		log.Fatalf("can't format generated source: %v", err)
+	}
+
+	if *outName == "" {
+		_, err = os.Stdout.Write(src)
+	} else {
+		err = ioutil.WriteFile(*outName, src, 0644)
+	}
+	if err != nil {
+		log.Fatalf("can't write Go source: %v", err)
+	}
+
+	if *jsName != "" {
+		js, err := jsoniter.MarshalIndent(d, "", "  ")
+		if err != nil {
+			log.Fatalf("can't marshal decisions: %v", err)
+		}
+		if err := ioutil.WriteFile(*jsName, append(js, '\n'), 0644); err != nil {
+			log.Fatalf("can't write \"%s\": %v", *jsName, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const goodTable = `
+  Count     | Name                           | Decision
+  ==========+================================+=====================
+  9171447313 IP::Checksum                    | Ignore
+  1279130958 IP::DiffServicesCP              | NEW dscp.0.changed
+   326560370 TCP::O::MSS                     | tcp.option.mss.changed
+         864 TCP::O::(null)                  |
+         458 TCP::O::CorruptionExperienced   | NEW tcp.option.corruption-experienced.changed
+
+*/
+`
+
+func TestParseDecisions(t *testing.T) {
+	d, err := parseDecisions(strings.NewReader(goodTable))
+	if err != nil {
+		t.Fatalf("can't parse table: %v", err)
+	}
+
+	if len(d.Mapped) != 3 || d.Mapped["TCP::O::MSS"] != "tcp.option.mss.changed" {
+		t.Errorf("unexpected mapping %v", d.Mapped)
+	}
+	if strings.Join(d.New, ",") != "dscp.0.changed,tcp.option.corruption-experienced.changed" {
+		t.Errorf("unexpected new conditions %v", d.New)
+	}
+	if strings.Join(d.Ignored, ",") != "IP::Checksum" {
+		t.Errorf("unexpected ignored names %v", d.Ignored)
+	}
+	if strings.Join(d.Undecided, ",") != "TCP::O::(null)" {
+		t.Errorf("unexpected undecided names %v", d.Undecided)
+	}
+}
+
+func TestGenerateIsSorted(t *testing.T) {
+	d, err := parseDecisions(strings.NewReader(goodTable))
+	if err != nil {
+		t.Fatalf("can't parse table: %v", err)
+	}
+
+	src, err := generate(d, "main", "test")
+	if err != nil {
+		t.Fatalf("can't generate source: %v", err)
+	}
+
+	s := string(src)
+	if strings.Index(s, `"IP::DiffServicesCP"`) > strings.Index(s, `"TCP::O::MSS"`) {
+		t.Errorf("mapping not sorted:\n%s", s)
+	}
+}
+
+func TestParseDecisionsErrors(t *testing.T) {
+	const header = "  ==========+================================+=====================\n"
+	bad := []string{
+		"no table here\n",
+		header + "   326560370 TCP::O::MSS tcp.option.mss.changed\n",
+		header + "   326560370 TCP::O::MSS | tcp.option.mss.changed\n        12 TCP::O::MSS | Ignore\n",
+		header + "   326560370 Foo | tcp.option.mss.changed\n",
+		header + "   326560370 TCP::O::MSS | tcp.option.MSS.changed\n",
+		header + "   326560370 TCP::O::MSS | NEW\n",
+		header + "   326560370 TCP::O::MSS | NEW Ignore\n",
+		header + "   326560370 TCP::O::MSS | tcp.option.mss.changed maybe\n",
+	}
+
+	for _, b := range bad {
+		if _, err := parseDecisions(strings.NewReader(b)); err == nil {
+			t.Errorf("expected error for table\n%s", b)
+		}
+	}
+}
+
+func TestMissingNames(t *testing.T) {
+	const header = "  ==========+================================+=====================\n"
+	d, err := parseDecisions(strings.NewReader(header +
+		"   326560370 TCP::O::MSS | tcp.option.mss.changed\n" +
+		"  9171447313 IP::Checksum | Ignore\n" +
+		"         864 TCP::O::Bogus |\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := readCounts(strings.NewReader(`{"files_processed": 1, "conditions": [
+		{"name": "IP::Checksum", "count": 10}, {"name": "IP::TTL", "count": 10},
+		{"name": "TCP::O::MSS", "count": 3}, {"name": "TCP::O::Bogus", "count": 1},
+		{"name": "TCP::O::Quick-StartResponse", "count": 1}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing := missingNames(d, counts)
+	if len(missing) != 2 || missing[0].Name != "IP::TTL" || missing[1].Name != "TCP::O::Quick-StartResponse" {
+		t.Errorf("bad missing names %v", missing)
+	}
+}
+
+func TestMapKeys(t *testing.T) {
+	src := []byte(`package main
+
+var tbAddToCond = map[string]string{
+	"TCP::O::SACKPermitted": "tcp.option.sackok.added",
+	"TCP::O::MSS":           "tcp.option.mss.added",
+}
+
+var tbDelToCond = map[string]string{
+	"Foo": "foo.stripped",
+}
+`)
+
+	keys, err := mapKeys(src, "test.go", "tbAddToCond")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "TCP::O::MSS,TCP::O::SACKPermitted" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	if _, err := mapKeys(src, "test.go", "tbDelToCond"); err == nil {
+		t.Error("expected error for a key that isn't a tracebox name")
+	}
+	if _, err := mapKeys(src, "test.go", "tbNoSuchMap"); err == nil {
+		t.Error("expected error for a missing variable")
+	}
+}
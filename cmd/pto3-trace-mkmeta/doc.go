@@ -43,8 +43,23 @@ name, which must have the form
 
 	<port>-<num>-<src_ip>.json
 
-where <src_ip> is an IPv4 address in dotted-quad notation. The program
-will log an error if the file name does not have this format, and no
-metadata file will be written.
+where <src_ip> is either an IPv4 address in dotted-quad notation or an
+IPv6 address, such as 80-1-2001:db8::1.json. IPv6 addresses are written
+to the metadata in their canonical (RFC 5952) form. The program will log
+an error if the file name does not have this format, and no metadata
+file will be written.
+
+The file name may be followed by a suffix such as .gz. Files compressed
+with gzip, bzip2, xz, or zstd are decompressed transparently.
+
+With -with-campaign, the campaign metadata also records what the
+probes presumably looked like: the TCP flags (-tcp-flags, default
+0x2), and, if given, the DSCP (-dscp), the TCP window (-tcp-window),
+and the TCP MSS option (-tcp-mss), all in hex. From these, the
+normalizer can say what a field was changed from, as in
+"0x5b4->0x564", and not only what it was changed to. DSCP changes are
+named after the DSCP they change, as in dscp.0.changed, so without -dscp
+the normalizer reports a DSCP change only once it has seen the DSCP a
+hop changed.
 */
 package main
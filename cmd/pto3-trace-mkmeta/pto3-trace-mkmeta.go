@@ -5,7 +5,6 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -15,13 +14,11 @@ import (
 	"math"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strconv"
-	"strings"
 	"time"
 
 	pto3 "github.com/mami-project/pto3-go"
 	trace "github.com/mami-project/pto3-trace"
+	"github.com/mami-project/pto3-trace/tracebox"
 )
 
 type campaignMeta struct {
@@ -33,6 +30,13 @@ type campaignMeta struct {
 	// changed from.
 	TCPFlags string `json:"presumed_tcp_flags"`
 
+	// The values we assume for the DSCP, the TCP window and the TCP MSS
+	// option of the probes. Like the flags, these let the normalizer
+	// say what a field was changed from. Left out if unknown.
+	DSCP      string `json:"presumed_dscp,omitempty"`
+	TCPWindow string `json:"presumed_tcp_window,omitempty"`
+	TCPMSS    string `json:"presumed_tcp_mss,omitempty"`
+
 	// The value for the timezone in which the measurements are taken.
 	// Tracebox does not record the time zone. The timezone can be either
 	// an official timezone, such as "GMT+2", "CEST", or "UTC", or an
@@ -52,10 +56,13 @@ type fileMeta struct {
 var (
 	campaign    = flag.Bool("with-campaign", false, "also write campaign metadata")
 	consolidate = flag.Bool("consolidate", false, "consolidate campaign and file metadata into single file (useful for debugging)")
+	dscp        = flag.String("dscp", "", "presumed DSCP for this tracebox campaign, e.g. \"0x0\" (default unknown)")
 	filetype    = flag.String("filetype", "tracebox-v1-ndjson", "file type of individual files")
 	logfileName = flag.String("logfile", "", "log file to use (default os.Stderr)")
 	owner       = flag.String("owner", "", "owner of the raw data")
 	tcpFlags    = flag.String("tcp-flags", "0x2", "presumed TCP flags for this tracebox campaign")
+	tcpMSS      = flag.String("tcp-mss", "", "presumed TCP MSS option for this tracebox campaign, e.g. \"0x5b4\" (default unknown)")
+	tcpWindow   = flag.String("tcp-window", "", "presumed TCP window for this tracebox campaign, e.g. \"0x2000\" (default unknown)")
 	timezone    = flag.String("timezone", "ProbablyUTC", "timezone for time stamps")
 )
 
@@ -100,10 +107,13 @@ func writeCampaignMeta() {
 	}
 
 	var cm = campaignMeta{
-		FileType: *filetype,
-		Owner:    *owner,
-		TCPFlags: *tcpFlags,
-		Timezone: *timezone,
+		FileType:  *filetype,
+		Owner:     *owner,
+		TCPFlags:  *tcpFlags,
+		DSCP:      *dscp,
+		TCPWindow: *tcpWindow,
+		TCPMSS:    *tcpMSS,
+		Timezone:  *timezone,
 	}
 
 	var mustRm = false
@@ -127,65 +137,66 @@ func writeCampaignMeta() {
 	}
 }
 
-var tbNameRe = regexp.MustCompile(`(\d+)-(\d+)-(\d{1,3})\.(\d{1,3})\.(\d{1,3})\.(\d{1,3})\.json`)
-var timestampRe = regexp.MustCompile(`"s":(\d+)`)
-
 func writeFileMeta(path string) {
 	fname := filepath.Base(path)
 
-	matches := tbNameRe.FindStringSubmatch(fname)
-	if matches == nil {
-		logger.Printf("ERROR: file name \"%s\" does not have expected form, skipping", fname)
+	fn, err := tracebox.ParseFileName(fname)
+	if err != nil {
+		logger.Printf("ERROR: %s: %v, skipping", fname, err)
 		return
 	}
+	port := fn.Port
+	vantage := fn.Source.String()
 
-	sport := matches[1]
-	port, err := strconv.ParseInt(sport, 10, 32)
+	f, err := os.Open(path)
 	if err != nil {
-		logger.Panicf("can't happen: number \"%s\" doesn't match number regexp", matches[1])
+		logger.Printf("ERROR: skipping file \"%s\": %v", path, err)
+		return
 	}
-	vantage := fmt.Sprintf("%s.%s.%s.%s", matches[3], matches[4], matches[5], matches[6])
 
-	f, err := os.Open(path)
+	reader, err := tracebox.NewReader(f)
 	if err != nil {
 		logger.Printf("ERROR: skipping file \"%s\": %v", path, err)
+		f.Close()
 		return
 	}
 
-	scanner := bufio.NewScanner(f)
-
 	var minSec int64 = math.MaxInt64
 	var maxSec int64
-	var lineno int
-
-	for scanner.Scan() {
-		lineno++
-		line := strings.TrimSpace(scanner.Text())
-		matches := timestampRe.FindStringSubmatch(line)
-		if matches == nil {
-			logger.Printf("WARNING: %s:%d: record without timestamp", path, lineno)
+
+	for reader.Next() {
+		var t tracebox.Trace
+		if err := reader.Decode(&t); err != nil {
+			logger.Printf("WARNING: %s:%d: can't decode record: %v", path, reader.Line(), err)
+			continue
 		}
 
-		s, err := strconv.ParseInt(matches[1], 10, 64)
-		if err != nil {
-			logger.Panicf("can't happen: number \"%s\" doesn't match number regexp", matches[1])
+		if t.Timestamp == 0 {
+			logger.Printf("WARNING: %s:%d: record without timestamp", path, reader.Line())
+			continue
 		}
 
-		if s < minSec {
-			minSec = s
+		if t.Timestamp < minSec {
+			minSec = t.Timestamp
 		}
-		if s > maxSec {
-			maxSec = s
+		if t.Timestamp > maxSec {
+			maxSec = t.Timestamp
 		}
 	}
 
+	if err := reader.Err(); err != nil {
+		logger.Printf("ERROR: skipping file \"%s\": %v", path, err)
+		f.Close()
+		return
+	}
+
 	if err := f.Close(); err != nil {
 		logger.Printf("WARNING: error closing \"%s\": %v", path, err)
 	}
 
 	md := fileMeta{
 		Vantage: vantage,
-		Port:    int(port),
+		Port:    port,
 		Start:   time.Unix(minSec, 0).UTC().Format(time.RFC3339),
 		End:     time.Unix(maxSec, 0).UTC().Format(time.RFC3339),
 	}
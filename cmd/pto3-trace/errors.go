@@ -0,0 +1,163 @@
+// Copyright 2018 Zurich University of Applied Sciences.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/json-iterator/go"
+)
+
+// What to do with a record that can't be normalized.
+const (
+	onErrorAbort      = "abort"      // stop normalizing
+	onErrorSkip       = "skip"       // count the record and go on
+	onErrorQuarantine = "quarantine" // like skip, but also write the record to a sidecar file
+)
+
+// errorPolicy handles records that can't be normalized. It is shared by
+// all unmarshallers and therefore safe for concurrent use.
+type errorPolicy struct {
+	sync.Mutex
+	action     string
+	quarantine *os.File
+}
+
+// policy is the error policy in use. It is set up from the -on-error flag.
+var policy = &errorPolicy{action: onErrorAbort}
+
+// quarantined is what gets written to the quarantine file, one per line.
+type quarantined struct {
+	Line   int    `json:"line"`
+	Error  string `json:"error"`
+	Record string `json:"record"`
+}
+
+func newErrorPolicy(action string, quarantinePath string) (*errorPolicy, error) {
+	ret := &errorPolicy{action: action}
+
+	switch action {
+	case onErrorAbort, onErrorSkip:
+	case onErrorQuarantine:
+		f, err := os.Create(quarantinePath)
+		if err != nil {
+			return nil, fmt.Errorf("can't create quarantine file: %v", err)
+		}
+		ret.quarantine = f
+	default:
+		return nil, fmt.Errorf("unknown error policy %s", action)
+	}
+
+	return ret, nil
+}
+
+// reject deals with the record rec on line lineno that failed with err. It
+// returns a non-nil error if normalization should be aborted. Counting the
+// record is up to the caller; see rejectRecord.
+func (p *errorPolicy) reject(lineno int, rec []byte, err error) error {
+	if p.action == onErrorAbort {
+		return fmt.Errorf("line %d: %v", lineno, err)
+	}
+
+	if p.quarantine == nil {
+		return nil
+	}
+
+	b, merr := jsoniter.Marshal(quarantined{Line: lineno, Error: err.Error(), Record: string(rec)})
+	if merr != nil {
+		return fmt.Errorf("line %d: can't quarantine record: %v", lineno, merr)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if _, werr := fmt.Fprintf(p.quarantine, "%s\n", b); werr != nil {
+		return fmt.Errorf("line %d: can't quarantine record: %v", lineno, werr)
+	}
+
+	return nil
+}
+
+func (p *errorPolicy) close() error {
+	if p.quarantine == nil {
+		return nil
+	}
+	return p.quarantine.Close()
+}
+
+// scanNumberedLines returns a split function that works like bufio.ScanLines,
+// except that each token is prefixed with its line number and a space. The
+// parallel normalizer hands records to the normalization function without
+// saying where they came from, so this is how we get line numbers for
+// error reports. Use splitLineNumber to take the token apart again.
+func scanNumberedLines() bufio.SplitFunc {
+	return numbered(bufio.ScanLines)
+}
+
+// numbered returns a split function that prefixes the tokens of split with
+// their number and a space. At the end of the input, it adds a token with
+// the negated number of tokens before it and nothing else, so that the
+// normalization functions know how many records there are; see runCounter.
+func numbered(split bufio.SplitFunc) bufio.SplitFunc {
+	var lineno int
+	var ended bool
+
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := split(data, atEOF)
+		if err != nil {
+			return advance, token, err
+		}
+		if token == nil {
+			if atEOF && advance == 0 && len(data) == 0 && !ended {
+				ended = true
+				return 0, strconv.AppendInt(nil, -int64(lineno), 10), nil
+			}
+			return advance, token, err
+		}
+
+		lineno++
+		numbered := strconv.AppendInt(make([]byte, 0, len(token)+12), int64(lineno), 10)
+		numbered = append(numbered, ' ')
+		numbered = append(numbered, token...)
+
+		return advance, numbered, nil
+	}
+}
+
+// endOfInput returns the number of records and true if token is the token
+// that numbered adds at the end of the input.
+func endOfInput(token []byte) (int, bool) {
+	if bytes.IndexByte(token, ' ') >= 0 {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(string(token))
+	if err != nil || n > 0 {
+		return 0, false
+	}
+
+	return -n, true
+}
+
+// splitLineNumber splits a token produced by scanNumberedLines into the
+// line number and the line.
+func splitLineNumber(token []byte) (int, []byte) {
+	i := bytes.IndexByte(token, ' ')
+	if i < 0 {
+		return 0, token
+	}
+
+	n, err := strconv.Atoi(string(token[:i]))
+	if err != nil {
+		return 0, token
+	}
+
+	return n, token[i+1:]
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+func TestScanNumberedLines(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("{\"a\":1}\n\n{\"b\":2}\n"))
+	scanner.Split(scanNumberedLines())
+
+	var got []string
+	for scanner.Scan() {
+		if n, ok := endOfInput(scanner.Bytes()); ok {
+			got = append(got, fmt.Sprintf("end after %d", n))
+			continue
+		}
+		n, line := splitLineNumber(scanner.Bytes())
+		got = append(got, strings.Repeat("#", n)+string(line))
+	}
+
+	want := "#{\"a\":1} ## ###{\"b\":2} end after 3"
+	if strings.Join(got, " ") != want {
+		t.Errorf("want %s, got %s", want, strings.Join(got, " "))
+	}
+}
+
+// rejectWith rejects a record with the error policy p, as the normalization
+// functions do, and returns the run statistics that end up in the metadata
+// and the error that rejecting returned.
+func rejectWith(p *errorPolicy, lineno int, rec []byte, err error) (map[string]interface{}, error) {
+	savedPolicy, savedRun := policy, run
+	defer func() { policy, run = savedPolicy, savedRun }()
+	policy, run = p, newRunCounter()
+
+	metachan := make(chan map[string]interface{}, 1)
+	rerr := rejectRecord(lineno, rec, err, metachan)
+	run.end(1, metachan)
+
+	select {
+	case md := <-metachan:
+		return md, rerr
+	default:
+		return nil, rerr
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pto3-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	qpath := filepath.Join(dir, "quarantine.ndjson")
+	p, err := newErrorPolicy(onErrorQuarantine, qpath)
+	if err != nil {
+		t.Fatalf("can't create error policy: %v", err)
+	}
+
+	md, err := rejectWith(p, 17, []byte(`{"dst":`), errors.New("unexpected end"))
+	if err != nil {
+		t.Errorf("quarantine should not abort: %v", err)
+	}
+	if md["rejected_lines"] != 1 {
+		t.Errorf("want 1 rejected line, got %v", md)
+	}
+	if err := p.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(qpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"line":17,"error":"unexpected end","record":"{\"dst\":"}` + "\n"
+	if string(b) != want {
+		t.Errorf("want quarantine %s, got %s", want, b)
+	}
+}
+
+func TestAbortAndSkip(t *testing.T) {
+	abort, _ := newErrorPolicy(onErrorAbort, "")
+	if _, err := rejectWith(abort, 1, nil, errors.New("bad")); err == nil {
+		t.Errorf("abort policy should return an error")
+	}
+
+	skip, _ := newErrorPolicy(onErrorSkip, "")
+	if md, err := rejectWith(skip, 1, nil, errors.New("bad")); err != nil || md["rejected_lines"] != 1 {
+		t.Errorf("skip policy should count and carry on, got %v, %v", md, err)
+	}
+
+	if _, err := newErrorPolicy("explode", ""); err == nil {
+		t.Errorf("unknown policy should be an error")
+	}
+}
+
+func TestBadDSCP(t *testing.T) {
+	const badDSCP = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "i":2, "m":[{"n":"IP::DiffServicesCP", "v":"zz"}], "a":[], "d":[]}]}`
+
+	if _, err := extractTraceboxV1Observations(src, "80", tbObsFromString(badDSCP)); err == nil {
+		t.Errorf("expected error for non-hex DSCP value")
+	}
+}
+
+func TestInvalidRecord(t *testing.T) {
+	const badDst = `{"dst":"88.212.202", "r":"tcp-rst", "s":1462315337, "h":[]}`
+	const noProbeType = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[]}`
+
+	// Records that can be normalized are only rejected with -validate.
+	if _, _, err := decodeV1(&fileInfo{srcIP: src}, []byte(badDst)); err != nil {
+		t.Errorf("invalid destination rejected without -validate: %v", err)
+	}
+
+	*validate = true
+	defer func() { *validate = false }()
+
+	if _, _, err := decodeV1(&fileInfo{srcIP: src}, []byte(badDst)); err == nil {
+		t.Errorf("expected error for invalid destination")
+	}
+	if _, _, err := decodeV2(&fileInfo{srcIP: src}, []byte(noProbeType)); err == nil {
+		t.Errorf("expected error for v2 record without probe type")
+	}
+}
+
+func TestNullHop(t *testing.T) {
+	const nullHop = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[null]}`
+
+	if _, _, err := decodeV1(&fileInfo{srcIP: src}, []byte(nullHop)); err == nil {
+		t.Errorf("expected error for null hop")
+	}
+
+	savedPolicy, savedRun := policy, run
+	defer func() { policy, run = savedPolicy, savedRun }()
+	policy, _ = newErrorPolicy(onErrorSkip, "")
+	run = newRunCounter()
+
+	md, err := pto3.RawMetadataFromReader(strings.NewReader(`{"src_ip": "`+src+`"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metachan := make(chan map[string]interface{}, 1)
+	obsen, err := normalizeV1([]byte("1 "+nullHop), md, metachan)
+	if err != nil || obsen != nil {
+		t.Errorf("skip policy should drop the record, got %v, %v", obsen, err)
+	}
+	run.end(1, metachan)
+	if m := <-metachan; m["rejected_lines"] != 1 {
+		t.Errorf("null hop not counted as rejected: %v", m)
+	}
+}
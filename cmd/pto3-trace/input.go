@@ -0,0 +1,56 @@
+// Copyright 2018 Zurich University of Applied Sciences.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+
+	trace "github.com/mami-project/pto3-trace"
+)
+
+// openInput returns f if it isn't compressed and a pipe from which the
+// decompressed contents of f can be read otherwise. Raw files are often
+// stored compressed, but the normalizer wants an *os.File.
+//
+// If f is seekable, the magic bytes are read without moving the offset, so
+// uncompressed files are read directly. Otherwise, everything goes through
+// the pipe, since we can't put back what we've read to find out.
+func openInput(f *os.File) (*os.File, error) {
+	if pos, err := f.Seek(0, io.SeekCurrent); err == nil {
+		head := make([]byte, trace.MagicLength)
+		n, err := f.ReadAt(head, pos)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if trace.Compression(head[:n]) == trace.CompressionNone {
+			return f, nil
+		}
+	}
+
+	din, err := trace.Decompress(f)
+	if err != nil {
+		return nil, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		// A truncated input would silently give truncated output, so
+		// give up instead.
+		if _, err := io.Copy(w, din); err != nil {
+			log.Fatalf("can't decompress input: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			log.Printf("can't close pipe: %v", err)
+		}
+	}()
+
+	return r, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func tempFileWith(t *testing.T, b []byte) *os.File {
+	f, err := ioutil.TempFile("", "pto3-trace-input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestOpenInput(t *testing.T) {
+	plain := []byte(mssAdded + "\n")
+
+	f := tempFileWith(t, plain)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	in, err := openInput(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in != f {
+		t.Errorf("uncompressed input not read directly")
+	}
+
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write(plain)
+	w.Close()
+
+	gz := tempFileWith(t, b.Bytes())
+	defer os.Remove(gz.Name())
+	defer gz.Close()
+
+	in, err = openInput(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Errorf("want %q, got %q", plain, got)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Zurich University of Applied Sciences.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/json-iterator/go"
+)
+
+// condMapping describes what becomes of a tracebox name such as TCP::O::MSS.
+// Each of Changed, Added, and Stripped is the PTO condition emitted when
+// tracebox reports the field as modified, added, or deleted, respectively.
+// An empty condition means that this kind of change isn't mapped.
+type condMapping struct {
+	Name     string `json:"name"`
+	Changed  string `json:"changed,omitempty"`
+	Added    string `json:"added,omitempty"`
+	Stripped string `json:"stripped,omitempty"`
+
+	// Encoding of observation values, either "hex" (the default) or
+	// "decimal".
+	Encoding string `json:"encoding,omitempty"`
+}
+
+const (
+	encodingHex     = "hex"
+	encodingDecimal = "decimal"
+)
+
+func (cm *condMapping) decimal() bool {
+	return cm.Encoding == encodingDecimal
+}
+
+type condTable map[string]*condMapping
+
+// conds is the mapping used for extraction. It starts out as the compiled-in
+// table and may be replaced with the -conditions flag.
+var conds = defaultCondTable()
+
+func (t condTable) entry(name string) *condMapping {
+	if t[name] == nil {
+		t[name] = &condMapping{Name: name, Encoding: encodingHex}
+	}
+	return t[name]
+}
+
+// defaultCondTable builds the condition table from the compiled-in maps
+// tbToCond, tbAddToCond, and tbDelToCond.
+func defaultCondTable() condTable {
+	ret := make(condTable)
+
+	for k, v := range tbToCond {
+		ret.entry(k).Changed = v
+		if v == dscpChanged {
+			ret.entry(k).Encoding = encodingDecimal
+		}
+	}
+	for k, v := range tbAddToCond {
+		ret.entry(k).Added = v
+	}
+	for k, v := range tbDelToCond {
+		ret.entry(k).Stripped = v
+	}
+
+	return ret
+}
+
+// readCondTable reads a condition table from r. The table is a JSON array
+// of objects with the same fields as condMapping, for example:
+//
+//	[
+//		{"name": "TCP::O::MSS", "changed": "tcp.option.mss.changed",
+//		 "added": "tcp.option.mss.added", "stripped": "tcp.option.mss.stripped"},
+//		{"name": "IP::DiffServicesCP", "changed": "dscp.0.changed", "encoding": "decimal"}
+//	]
+//
+// Names that don't appear in the table are ignored.
+func readCondTable(r io.Reader) (condTable, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var mappings []*condMapping
+	if err := jsoniter.Unmarshal(b, &mappings); err != nil {
+		return nil, err
+	}
+
+	ret := make(condTable)
+	for i, cm := range mappings {
+		if cm.Name == "" {
+			return nil, fmt.Errorf("entry %d: no name", i)
+		}
+		if ret[cm.Name] != nil {
+			return nil, fmt.Errorf("entry %d: duplicate name %s", i, cm.Name)
+		}
+		if cm.Changed == "" && cm.Added == "" && cm.Stripped == "" {
+			return nil, fmt.Errorf("entry %d: %s maps to no condition", i, cm.Name)
+		}
+
+		switch cm.Encoding {
+		case "":
+			cm.Encoding = encodingHex
+		case encodingHex, encodingDecimal:
+		default:
+			return nil, fmt.Errorf("entry %d: unknown encoding %s", i, cm.Encoding)
+		}
+
+		ret[cm.Name] = cm
+	}
+
+	return ret, nil
+}
+
+func loadCondTable(path string) (condTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret, err := readCondTable(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return ret, nil
+}
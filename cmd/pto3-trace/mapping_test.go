@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const mssOnlyTable = `[
+	{"name": "TCP::O::MSS", "changed": "tcp.option.mss.changed", "stripped": "tcp.option.mss.stripped", "encoding": "decimal"}
+]`
+
+func TestReadCondTable(t *testing.T) {
+	table, err := readCondTable(strings.NewReader(mssOnlyTable))
+	if err != nil {
+		t.Fatalf("can't read condition table: %v", err)
+	}
+
+	cm := table["TCP::O::MSS"]
+	if cm == nil {
+		t.Fatalf("TCP::O::MSS not in table")
+	}
+	if cm.Added != "" || cm.Stripped != "tcp.option.mss.stripped" || !cm.decimal() {
+		t.Errorf("unexpected mapping for TCP::O::MSS: %+v", *cm)
+	}
+}
+
+func TestReadCondTableErrors(t *testing.T) {
+	bad := []string{
+		`[{"changed": "tcp.option.mss.changed"}]`,
+		`[{"name": "TCP::O::MSS"}]`,
+		`[{"name": "TCP::O::MSS", "changed": "tcp.option.mss.changed", "encoding": "octal"}]`,
+		`[{"name": "TCP::O::MSS", "changed": "tcp.option.mss.changed"}, {"name": "TCP::O::MSS", "added": "tcp.option.mss.added"}]`,
+	}
+
+	for _, b := range bad {
+		if _, err := readCondTable(strings.NewReader(b)); err == nil {
+			t.Errorf("expected error for table %s", b)
+		}
+	}
+}
+
+func TestExtractWithCondTable(t *testing.T) {
+	table, err := readCondTable(strings.NewReader(mssOnlyTable))
+	if err != nil {
+		t.Fatalf("can't read condition table: %v", err)
+	}
+
+	saved := conds
+	conds = table
+	defer func() { conds = saved }()
+
+	obsen, err := extractTraceboxV1Observations(src, "80", tbObsFromString(mssAdded))
+	if err != nil {
+		t.Fatalf("can't extract observations: %v", err)
+	}
+
+	testObservationCount(t, obsen, "tcp.option.mss.added", 0)
+}
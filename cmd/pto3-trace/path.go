@@ -1,11 +1,64 @@
 package main
 
 import (
+	"net"
 	"strings"
 
 	pto3 "github.com/mami-project/pto3-go"
+	"github.com/mami-project/pto3-trace/tracebox"
 )
 
+// fillTTLGaps returns tbobs with a "*" hop inserted for every TTL that
+// tracebox skipped because the hop didn't respond, so that the hop at index
+// k has TTL k+1. If the hops don't pass tracebox's CheckHops or the TTLs
+// don't increase strictly, there's no telling where the gaps are, and tbobs
+// is returned unchanged.
+func fillTTLGaps(tbobs *tracebox.Trace) *tracebox.Trace {
+	if tbobs.CheckHops() != nil {
+		return tbobs
+	}
+
+	expected := 1
+	gaps := false
+
+	for _, h := range tbobs.Hops {
+		if h.TTL < expected {
+			return tbobs
+		}
+		if h.TTL > expected {
+			gaps = true
+		}
+		expected = h.TTL + 1
+	}
+
+	if !gaps {
+		return tbobs
+	}
+
+	ret := *tbobs
+	ret.Hops = make([]*tracebox.Hop, 0, expected-1)
+
+	for _, h := range tbobs.Hops {
+		for len(ret.Hops) < h.TTL-1 {
+			ret.Hops = append(ret.Hops, &tracebox.Hop{Address: "*", TTL: len(ret.Hops) + 1})
+		}
+		ret.Hops = append(ret.Hops, h)
+	}
+
+	return &ret
+}
+
+// makeTarget returns the path target for the destination address dst and the
+// TCP destination port port, e.g., "88.212.202.2:443" or "[2001:db8::2]:443".
+// Without a port, the target is just the destination address.
+func makeTarget(dst string, port string) string {
+	if port == "" {
+		return dst
+	}
+
+	return net.JoinHostPort(dst, port)
+}
+
 // conversation between @britram and @sten69 on slack:
 //
 // @sten69: "if change happens between `A` and `B`, then the path is `[S B * D]` if `A` = `S`,
@@ -29,16 +82,19 @@ import (
 // 8  n > 2, k = n-1     [S * Pk-1 Pk D]
 // 9  n > 3, 2 <= k < n-1 [S * Pk-1 Pk * D]
 //
+// The destination is written as the target, which may carry the TCP destination port
+// (see makeTarget), so D is really "D:port".
+//
 // Additional rule: adjacent "*"s are collapsed. This can happen if the lower of the Pj is "*"
 // and there is already a "*" there (cases n > 2, k = n-1 and n > 3, 1 <= k < n-1).
 //
-func makePathForChange(old *pto3.Path, source string, tbobs *tbObs, index int) *pto3.Path {
+func makePathForChange(old *pto3.Path, source string, target string, tbobs *tracebox.Trace, index int) *pto3.Path {
 	if old != nil {
 		return old
 	}
 
 	n := len(tbobs.Hops)
-	if n > 0 && tbobs.Hops[n-1].Address == tbobs.Dst {
+	if n > 0 && tracebox.SameAddress(tbobs.Hops[n-1].Address, tbobs.Dst) {
 		n--
 	}
 
@@ -96,18 +152,81 @@ func makePathForChange(old *pto3.Path, source string, tbobs *tbObs, index int) *
 		pathString.WriteString(" *")
 	}
 	pathString.WriteString(" ")
-	pathString.WriteString(tbobs.Dst)
+	pathString.WriteString(target)
 
 	return pto3.NewPath(pathString.String())
 }
 
-func makeFullPath(source string, tbobs *tbObs) *pto3.Path {
+// How paths for changes are written, selected with the -path-mode flag.
+const (
+	pathModeAbbreviated = "abbreviated" // [S * A B * D], see makePathForChange
+	pathModeFull        = "full"        // all hops, see makeFullPath
+	pathModeSegment     = "segment"     // [A B], see makeSegmentPath
+)
+
+func validPathMode(mode string) bool {
+	switch mode {
+	case pathModeAbbreviated, pathModeFull, pathModeSegment:
+		return true
+	}
+	return false
+}
+
+// makePathForMode returns the path for a change at the hop with the given
+// index, written according to mode. Like makePathForChange, it returns old
+// if that isn't nil, so that all changes at a hop share one path.
+func makePathForMode(old *pto3.Path, mode string, source string, target string, tbobs *tracebox.Trace, index int) *pto3.Path {
+	if old != nil {
+		return old
+	}
+
+	switch mode {
+	case pathModeFull:
+		return makeFullPath(source, target, tbobs)
+	case pathModeSegment:
+		return makeSegmentPath(source, target, tbobs, index)
+	default:
+		return makePathForChange(nil, source, target, tbobs, index)
+	}
+}
+
+// makeSegmentPath returns just the segment [A B] between which the change
+// happened, where A is the source if the change happened at the first hop
+// and B is the target if it happened after the last hop.
+func makeSegmentPath(source string, target string, tbobs *tracebox.Trace, index int) *pto3.Path {
+	n := len(tbobs.Hops)
+	if n > 0 && tracebox.SameAddress(tbobs.Hops[n-1].Address, tbobs.Dst) {
+		n--
+	}
+
+	lower := source
+	if index > 0 && index <= n {
+		lower = tbobs.Hops[index-1].Address
+	}
+
+	upper := target
+	if index < n {
+		upper = tbobs.Hops[index].Address
+	}
+
+	return pto3.NewPath(lower + " " + upper)
+}
+
+// makeFullPath returns the path from source through all hops to target,
+// collapsing adjacent "*"s. If the last hop is the destination, it is
+// written as the target.
+func makeFullPath(source string, target string, tbobs *tracebox.Trace) *pto3.Path {
 	var pathString strings.Builder
 
 	pathString.WriteString(source)
 
+	hops := tbobs.Hops
+	if n := len(hops); n > 0 && tracebox.SameAddress(hops[n-1].Address, tbobs.Dst) {
+		hops = hops[:n-1]
+	}
+
 	var printingStars bool
-	for _, h := range tbobs.Hops {
+	for _, h := range hops {
 		if h.Address != "*" {
 			if printingStars {
 				pathString.WriteString(" *")
@@ -122,10 +241,34 @@ func makeFullPath(source string, tbobs *tbObs) *pto3.Path {
 		pathString.WriteString(" *")
 	}
 
-	if tbobs.Hops[len(tbobs.Hops)-1].Address != tbobs.Dst {
-		pathString.WriteString(" ")
-		pathString.WriteString(tbobs.Dst)
+	pathString.WriteString(" ")
+	pathString.WriteString(target)
+
+	return pto3.NewPath(pathString.String())
+}
+
+// makeHopPath returns the path that singles out the hop with the given index,
+// i.e., [S * Pk * D], with the "*"s left out where Pk is the first or last
+// hop before the destination.
+func makeHopPath(source string, target string, tbobs *tracebox.Trace, index int) *pto3.Path {
+	var pathString strings.Builder
+
+	n := len(tbobs.Hops)
+	if n > 0 && tracebox.SameAddress(tbobs.Hops[n-1].Address, tbobs.Dst) {
+		n--
 	}
 
+	pathString.WriteString(source)
+	if index > 0 {
+		pathString.WriteString(" *")
+	}
+	pathString.WriteString(" ")
+	pathString.WriteString(tbobs.Hops[index].Address)
+	if index < n-1 {
+		pathString.WriteString(" *")
+	}
+	pathString.WriteString(" ")
+	pathString.WriteString(target)
+
 	return pto3.NewPath(pathString.String())
 }
@@ -1,9 +1,10 @@
 package main
 
 import (
-	"encoding/json"
 	"log"
 	"testing"
+
+	"github.com/mami-project/pto3-trace/tracebox"
 )
 
 const src = "128.112.139.42"
@@ -18,9 +19,9 @@ const longPathStarBeginning = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315
 const longPathStarMiddle = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "i":2, "m":[], "a":[], "d":[]},{"ha":"128.112.12.57", "t":2, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"128.112.12.142", "t":3, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"63.138.53.73", "t":4, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"67.151.33.22", "t":5, "i":3, "m":[{"n":"IP::TTL", "v":"02"}, {"n":"IP::Checksum", "v":"8a56"}], "a":[], "d":[]},{"ha":"63.138.198.162", "t":6, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"213.248.95.21", "t":7, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"62.115.112.248", "t":8, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"62.115.141.96", "t":9, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"62.115.139.166", "t":10, "i":3, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"62.115.116.233", "t":11, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"*", "t":12, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"88.212.194.82", "t":13, "i":3, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"88.212.202.2", "t":14, "i":0, "m":[], "a":[], "d":[]}]}`
 const longPathStarEnd = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "i":2, "m":[], "a":[], "d":[]},{"ha":"128.112.12.57", "t":2, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"128.112.12.142", "t":3, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"63.138.53.73", "t":4, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"67.151.33.22", "t":5, "i":3, "m":[{"n":"IP::TTL", "v":"02"}, {"n":"IP::Checksum", "v":"8a56"}], "a":[], "d":[]},{"ha":"63.138.198.162", "t":6, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"213.248.95.21", "t":7, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"62.115.112.248", "t":8, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"62.115.141.96", "t":9, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"62.115.139.166", "t":10, "i":3, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"62.115.116.233", "t":11, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"62.115.144.69", "t":12, "i":2, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"88.212.194.82", "t":13, "i":3, "m":[{"n":"IP::TTL", "v":"01"}, {"n":"IP::Checksum", "v":"8b56"}], "a":[], "d":[]},{"ha":"*", "t":14, "i":0, "m":[], "a":[], "d":[]}]}`
 
-func tbObsFromString(s string) *tbObs {
-	var ret tbObs
-	if err := json.Unmarshal([]byte(s), &ret); err != nil {
+func tbObsFromString(s string) *tracebox.Trace {
+	var ret tracebox.Trace
+	if err := tracebox.Unmarshal([]byte(s), &ret); err != nil {
 		log.Panicf("can't unmarshal test data %v: %v", s, err)
 	}
 	return &ret
@@ -34,65 +35,65 @@ func testPathsEquals(t *testing.T, want, got string) {
 
 func TestNoPathChange(t *testing.T) {
 	tbobs := tbObsFromString(noPath)
-	path := makePathForChange(nil, src, tbobs, 0)
+	path := makePathForChange(nil, src, tbobs.Dst, tbobs, 0)
 	testPathsEquals(t, "128.112.139.42 88.212.202.2", path.String)
 }
 
 func TestOnePathChange(t *testing.T) {
 	tbobs := tbObsFromString(onePath)
-	path := makePathForChange(nil, src, tbobs, 0)
+	path := makePathForChange(nil, src, tbobs.Dst, tbobs, 0)
 	testPathsEquals(t, "128.112.139.42 128.112.139.1 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 1)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 1)
 	testPathsEquals(t, "128.112.139.42 128.112.139.1 88.212.202.2", path.String)
 }
 
 func TestOnePathStarChange(t *testing.T) {
 	tbobs := tbObsFromString(onePathStar)
-	path := makePathForChange(nil, src, tbobs, 0)
+	path := makePathForChange(nil, src, tbobs.Dst, tbobs, 0)
 	testPathsEquals(t, "128.112.139.42 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 1)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 1)
 	testPathsEquals(t, "128.112.139.42 * 88.212.202.2", path.String)
 }
 
 func TestTwoPathChange(t *testing.T) {
 	tbobs := tbObsFromString(twoPath)
-	path := makePathForChange(nil, src, tbobs, 0)
+	path := makePathForChange(nil, src, tbobs.Dst, tbobs, 0)
 	testPathsEquals(t, "128.112.139.42 128.112.139.1 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 1)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 1)
 	testPathsEquals(t, "128.112.139.42 128.112.139.1 128.112.12.57 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 2)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 2)
 	testPathsEquals(t, "128.112.139.42 * 128.112.12.57 88.212.202.2", path.String)
 }
 
 func TestLongPathChange(t *testing.T) {
 	tbobs := tbObsFromString(longPath)
-	path := makePathForChange(nil, src, tbobs, 0)
+	path := makePathForChange(nil, src, tbobs.Dst, tbobs, 0)
 	testPathsEquals(t, "128.112.139.42 128.112.139.1 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 1)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 1)
 	testPathsEquals(t, "128.112.139.42 128.112.139.1 128.112.12.57 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 2)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 2)
 	testPathsEquals(t, "128.112.139.42 * 128.112.12.57 128.112.12.142 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 3)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 3)
 	testPathsEquals(t, "128.112.139.42 * 128.112.12.142 63.138.53.73 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 4)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 4)
 	testPathsEquals(t, "128.112.139.42 * 63.138.53.73 67.151.33.22 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 5)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 5)
 	testPathsEquals(t, "128.112.139.42 * 67.151.33.22 63.138.198.162 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 6)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 6)
 	testPathsEquals(t, "128.112.139.42 * 63.138.198.162 213.248.95.21 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 7)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 7)
 	testPathsEquals(t, "128.112.139.42 * 213.248.95.21 62.115.112.248 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 8)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 8)
 	testPathsEquals(t, "128.112.139.42 * 62.115.112.248 62.115.141.96 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 9)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 9)
 	testPathsEquals(t, "128.112.139.42 * 62.115.141.96 62.115.139.166 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 10)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 10)
 	testPathsEquals(t, "128.112.139.42 * 62.115.139.166 62.115.116.233 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 11)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 11)
 	testPathsEquals(t, "128.112.139.42 * 62.115.116.233 62.115.144.69 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 12)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 12)
 	testPathsEquals(t, "128.112.139.42 * 62.115.144.69 88.212.194.82 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 13)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 13)
 	testPathsEquals(t, "128.112.139.42 * 88.212.194.82 88.212.202.2", path.String)
 }
 
@@ -102,65 +103,169 @@ func TestLongPathStarBeginningChange(t *testing.T) {
 	// This must give the wrong result since we can't have * give anything
 	// in the a[], m[] or d[] arrays.
 	//
-	//path := makePathForChange(nil, src, tbobs, 0)
+	//path := makePathForChange(nil, src, tbobs.Dst, tbobs, 0)
 	//testPathsEquals(t, "128.112.139.42 * 88.212.202.2", path.String)
-	path := makePathForChange(nil, src, tbobs, 1)
+	path := makePathForChange(nil, src, tbobs.Dst, tbobs, 1)
 	testPathsEquals(t, "128.112.139.42 * 128.112.12.57 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 2)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 2)
 	testPathsEquals(t, "128.112.139.42 * 128.112.12.57 128.112.12.142 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 3)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 3)
 	testPathsEquals(t, "128.112.139.42 * 128.112.12.142 63.138.53.73 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 4)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 4)
 	testPathsEquals(t, "128.112.139.42 * 63.138.53.73 67.151.33.22 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 5)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 5)
 	testPathsEquals(t, "128.112.139.42 * 67.151.33.22 63.138.198.162 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 6)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 6)
 	testPathsEquals(t, "128.112.139.42 * 63.138.198.162 213.248.95.21 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 7)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 7)
 	testPathsEquals(t, "128.112.139.42 * 213.248.95.21 62.115.112.248 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 8)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 8)
 	testPathsEquals(t, "128.112.139.42 * 62.115.112.248 62.115.141.96 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 9)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 9)
 	testPathsEquals(t, "128.112.139.42 * 62.115.141.96 62.115.139.166 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 10)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 10)
 	testPathsEquals(t, "128.112.139.42 * 62.115.139.166 62.115.116.233 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 11)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 11)
 	testPathsEquals(t, "128.112.139.42 * 62.115.116.233 62.115.144.69 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 12)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 12)
 	testPathsEquals(t, "128.112.139.42 * 62.115.144.69 88.212.194.82 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 13)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 13)
 	testPathsEquals(t, "128.112.139.42 * 88.212.194.82 88.212.202.2", path.String)
 }
 
 func TestLongPathStarMiddleChange(t *testing.T) {
 	tbobs := tbObsFromString(longPathStarMiddle)
 
-	path := makePathForChange(nil, src, tbobs, 0)
+	path := makePathForChange(nil, src, tbobs.Dst, tbobs, 0)
 	testPathsEquals(t, "128.112.139.42 128.112.139.1 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 1)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 1)
 	testPathsEquals(t, "128.112.139.42 128.112.139.1 128.112.12.57 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 2)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 2)
 	testPathsEquals(t, "128.112.139.42 * 128.112.12.57 128.112.12.142 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 3)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 3)
 	testPathsEquals(t, "128.112.139.42 * 128.112.12.142 63.138.53.73 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 4)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 4)
 	testPathsEquals(t, "128.112.139.42 * 63.138.53.73 67.151.33.22 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 5)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 5)
 	testPathsEquals(t, "128.112.139.42 * 67.151.33.22 63.138.198.162 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 6)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 6)
 	testPathsEquals(t, "128.112.139.42 * 63.138.198.162 213.248.95.21 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 7)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 7)
 	testPathsEquals(t, "128.112.139.42 * 213.248.95.21 62.115.112.248 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 8)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 8)
 	testPathsEquals(t, "128.112.139.42 * 62.115.112.248 62.115.141.96 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 9)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 9)
 	testPathsEquals(t, "128.112.139.42 * 62.115.141.96 62.115.139.166 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 10)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 10)
 	testPathsEquals(t, "128.112.139.42 * 62.115.139.166 62.115.116.233 * 88.212.202.2", path.String)
-	//path = makePathForChange(nil, src, tbobs, 11)
+	//path = makePathForChange(nil, src, tbobs.Dst, tbobs, 11)
 	//testPathsEquals(t, "128.112.139.42 * 62.115.116.233 62.115.144.69 * 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 12)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 12)
 	testPathsEquals(t, "128.112.139.42 * 88.212.194.82 88.212.202.2", path.String)
-	path = makePathForChange(nil, src, tbobs, 13)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 13)
 	testPathsEquals(t, "128.112.139.42 * 88.212.194.82 88.212.202.2", path.String)
 }
+
+const src6 = "2001:db8:1::42"
+const longPath6 = `{"dst":"2001:db8:ff::2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"2001:db8:1::1", "t":1, "i":2, "m":[], "a":[], "d":[]},{"ha":"2001:db8:2::1", "t":2, "i":2, "m":[{"n":"IPv6::FlowLabel", "v":"12345"}], "a":[], "d":[]},{"ha":"2001:db8:3::1", "t":3, "i":2, "m":[{"n":"IPv6::FlowLabel", "v":"12345"}], "a":[], "d":[]},{"ha":"2001:db8:4::1", "t":4, "i":2, "m":[], "a":[], "d":[]},{"ha":"2001:0db8:00ff:0000:0000:0000:0000:0002", "t":5, "i":0, "m":[], "a":[], "d":[]}]}`
+
+func TestLongPath6Change(t *testing.T) {
+	tbobs := tbObsFromString(longPath6)
+	path := makePathForChange(nil, src6, tbobs.Dst, tbobs, 0)
+	testPathsEquals(t, "2001:db8:1::42 2001:db8:1::1 * 2001:db8:ff::2", path.String)
+	path = makePathForChange(nil, src6, tbobs.Dst, tbobs, 1)
+	testPathsEquals(t, "2001:db8:1::42 2001:db8:1::1 2001:db8:2::1 * 2001:db8:ff::2", path.String)
+	path = makePathForChange(nil, src6, tbobs.Dst, tbobs, 2)
+	testPathsEquals(t, "2001:db8:1::42 * 2001:db8:2::1 2001:db8:3::1 * 2001:db8:ff::2", path.String)
+	path = makePathForChange(nil, src6, tbobs.Dst, tbobs, 3)
+	testPathsEquals(t, "2001:db8:1::42 * 2001:db8:3::1 2001:db8:4::1 2001:db8:ff::2", path.String)
+	path = makePathForChange(nil, src6, tbobs.Dst, tbobs, 4)
+	testPathsEquals(t, "2001:db8:1::42 * 2001:db8:4::1 2001:db8:ff::2", path.String)
+}
+
+func TestFullPathMode(t *testing.T) {
+	tbobs := tbObsFromString(longPathStarMiddle)
+	want := "128.112.139.42 128.112.139.1 128.112.12.57 128.112.12.142 63.138.53.73 67.151.33.22 63.138.198.162 213.248.95.21 62.115.112.248 62.115.141.96 62.115.139.166 62.115.116.233 * 88.212.194.82 88.212.202.2"
+	for i := 0; i <= 13; i++ {
+		path := makePathForMode(nil, pathModeFull, src, tbobs.Dst, tbobs, i)
+		testPathsEquals(t, want, path.String)
+	}
+
+	tbobs = tbObsFromString(longPathStarEnd)
+	path := makePathForMode(nil, pathModeFull, src, tbobs.Dst, tbobs, 3)
+	testPathsEquals(t, "128.112.139.42 128.112.139.1 128.112.12.57 128.112.12.142 63.138.53.73 67.151.33.22 63.138.198.162 213.248.95.21 62.115.112.248 62.115.141.96 62.115.139.166 62.115.116.233 62.115.144.69 88.212.194.82 * 88.212.202.2", path.String)
+
+	tbobs = tbObsFromString(twoPathStarBeginning)
+	path = makePathForMode(nil, pathModeFull, src, "88.212.202.2:443", tbobs, 1)
+	testPathsEquals(t, "128.112.139.42 * 128.112.12.57 88.212.202.2:443", path.String)
+}
+
+func TestSegmentPathMode(t *testing.T) {
+	tbobs := tbObsFromString(noPath)
+	path := makePathForMode(nil, pathModeSegment, src, tbobs.Dst, tbobs, 0)
+	testPathsEquals(t, "128.112.139.42 88.212.202.2", path.String)
+
+	tbobs = tbObsFromString(longPath)
+	path = makePathForMode(nil, pathModeSegment, src, tbobs.Dst, tbobs, 0)
+	testPathsEquals(t, "128.112.139.42 128.112.139.1", path.String)
+	path = makePathForMode(nil, pathModeSegment, src, tbobs.Dst, tbobs, 1)
+	testPathsEquals(t, "128.112.139.1 128.112.12.57", path.String)
+	path = makePathForMode(nil, pathModeSegment, src, tbobs.Dst, tbobs, 12)
+	testPathsEquals(t, "62.115.144.69 88.212.194.82", path.String)
+	path = makePathForMode(nil, pathModeSegment, src, tbobs.Dst, tbobs, 13)
+	testPathsEquals(t, "88.212.194.82 88.212.202.2", path.String)
+
+	tbobs = tbObsFromString(longPathStarMiddle)
+	path = makePathForMode(nil, pathModeSegment, src, tbobs.Dst, tbobs, 12)
+	testPathsEquals(t, "* 88.212.194.82", path.String)
+}
+
+func TestAbbreviatedPathMode(t *testing.T) {
+	tbobs := tbObsFromString(longPath)
+	for i := 0; i <= 13; i++ {
+		want := makePathForChange(nil, src, tbobs.Dst, tbobs, i)
+		got := makePathForMode(nil, pathModeAbbreviated, src, tbobs.Dst, tbobs, i)
+		testPathsEquals(t, want.String, got.String)
+	}
+}
+
+const gapPath = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "i":2, "m":[], "a":[], "d":[]},{"ha":"128.112.12.57", "t":2, "i":2, "m":[], "a":[], "d":[]},{"ha":"63.138.53.73", "t":4, "i":2, "m":[{"n":"TCP::O::MSS", "v":"0564"}], "a":[], "d":[]},{"ha":"67.151.33.22", "t":5, "i":2, "m":[{"n":"TCP::O::MSS", "v":"0564"}], "a":[], "d":[]},{"ha":"63.138.198.162", "t":6, "i":2, "m":[], "a":[], "d":[]},{"ha":"88.212.202.2", "t":8, "i":0, "m":[], "a":[], "d":[]}]}`
+
+func TestFillTTLGaps(t *testing.T) {
+	tbobs := fillTTLGaps(tbObsFromString(gapPath))
+
+	if len(tbobs.Hops) != 8 {
+		t.Fatalf("want 8 hops, got %d", len(tbobs.Hops))
+	}
+	for i, h := range tbobs.Hops {
+		if h.TTL != i+1 {
+			t.Errorf("hop %d: want TTL %d, got %d", i, i+1, h.TTL)
+		}
+	}
+
+	path := makePathForChange(nil, src, tbobs.Dst, tbobs, 3)
+	testPathsEquals(t, "128.112.139.42 * 63.138.53.73 * 88.212.202.2", path.String)
+	path = makePathForChange(nil, src, tbobs.Dst, tbobs, 7)
+	testPathsEquals(t, "128.112.139.42 * 88.212.202.2", path.String)
+	path = makeFullPath(src, tbobs.Dst, tbobs)
+	testPathsEquals(t, "128.112.139.42 128.112.139.1 128.112.12.57 * 63.138.53.73 67.151.33.22 63.138.198.162 * 88.212.202.2", path.String)
+
+	unordered := tbObsFromString(longPath)
+	unordered.Hops[3].TTL = 1
+	if fillTTLGaps(unordered) != unordered {
+		t.Errorf("hops with non-increasing TTLs should be left alone")
+	}
+}
+
+func TestHugeTTL(t *testing.T) {
+	const hugeTTL = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "i":2, "m":[], "a":[], "d":[]},{"ha":"63.138.53.73", "t":4000000000000000000, "i":2, "m":[{"n":"TCP::O::MSS", "v":"0564"}], "a":[], "d":[]}]}`
+
+	tbobs := tbObsFromString(hugeTTL)
+	if fillTTLGaps(tbobs) != tbobs {
+		t.Errorf("hops with invalid TTLs should be left alone")
+	}
+
+	if _, err := extractTraceboxV1Observations(src, "80", tbobs); err == nil {
+		t.Errorf("expected error for invalid TTL")
+	}
+}
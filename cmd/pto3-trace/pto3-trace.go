@@ -2,7 +2,7 @@
 // All rights reserved. Use of this source code is governed
 // by a BSD-style license that can be found in the LICENSE file.
 
-//go:generate perl extract-conditions.pl pto3-trace.go conditions.go
+//go:generate go run ../pto3-trace-gencond -o conditions.go pto3-trace.go
 
 package main
 
@@ -26,8 +26,18 @@ package main
 	 middlebox may well add or change.
 
    The format of the table below is crucial, since it is being automatically
-   processed by extract-conditions.pl. So you can't remove this table, only
-   change the Decision column.
+   processed by pto3-trace-gencond. So you can't remove this table, only
+   change the Decision column. Rows that gencond can't parse, duplicate names,
+   and conditions that don't look like PTO conditions make go generate fail.
+
+   The campaign from which the counts were taken was IPv4 only, so the IPv6
+   names at the end of the table have a count of 0. Their decisions mirror
+   those of the corresponding IPv4 names. A middlebox inserting or removing
+   an IPv6 extension header shows up as a change of IPv6::NextHeader (and of
+   IPv6::PayloadLength), since tracebox reports changes to the fixed header.
+
+   The compiled-in table can be replaced at run time with the -conditions
+   flag, which names a JSON file in the format described at readCondTable.
 
   Count     | Name                           | Decision
   ==========+================================+=====================
@@ -73,45 +83,131 @@ package main
          526 TCP::O::RecordBoundaries        | NEW tcp.option.record-boundaries.changed
          525 TCP::O::MultipathTCP            | NEW tcp.option.mptcp.changed
          458 TCP::O::CorruptionExperienced   | NEW tcp.option.corruption-experienced.changed
+           0 IPv6::HopLimit                  | Ignore
+           0 IPv6::TrafficClass              | NEW ip6.tc.changed
+           0 IPv6::FlowLabel                 | NEW ip6.flowlabel.changed
+           0 IPv6::PayloadLength             | NEW ip6.length.changed
+           0 IPv6::NextHeader                | NEW ip6.nexthdr.changed
 
 */
 import (
-	"bufio"
-	"bytes"
 	//"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	pto3 "github.com/mami-project/pto3-go"
 	trace "github.com/mami-project/pto3-trace"
-
-	"github.com/json-iterator/go"
+	"github.com/mami-project/pto3-trace/tracebox"
 )
 
-type nameValue struct {
-	Name  string `json:"n"`
-	Value string `json:"v"`
+// tbAddToCond maps the names of header fields that tracebox reports as added
+// somewhere along the path to PTO conditions. Only TCP options can sensibly be
+// added by a middlebox, so that's all there is in here.
+var tbAddToCond = map[string]string{
+	"TCP::O::MSS":                             "tcp.option.mss.added",
+	"TCP::O::SACKPermitted":                   "tcp.option.sackok.added",
+	"TCP::O::WSOPT-WindowScale":               "tcp.option.ws.added",
+	"TCP::O::TSOPT-TimeStampOption":           "tcp.option.ts.added",
+	"TCP::O::TCPAuthenticationOption":         "tcp.option.ao.added",
+	"TCP::O::Echo":                            "tcp.option.rfc1072.echo.added",
+	"TCP::O::CC":                              "tcp.option.rfc1644.cc.added",
+	"TCP::O::CC.ECHO":                         "tcp.option.rfc1644.echo.added",
+	"TCP::O::MD5SignatureOption":              "tcp.option.md5.added",
+	"TCP::O::CC.NEW":                          "tcp.option.rfc1644.new.added",
+	"TCP::O::Quick-StartResponse":             "tcp.option.rfc4782.added",
+	"TCP::O::EchoReply":                       "tcp.option.rfc1072.reply.added",
+	"TCP::O::PartialOrderConnectionPermitted": "tcp.option.rfc1693.permitted.added",
+	"TCP::O::TCPAlternateChecksumRequest":     "tcp.option.rfc1146.request.added",
+	"TCP::O::SACK":                            "tcp.option.sack.added",
+	"TCP::O::SNAP":                            "tcp.option.snap.added",
+	"TCP::O::UserTimeoutOption":               "tcp.option.user-timeout.added",
+	"TCP::O::TrailerChecksumOption":           "tcp.option.trailer-checksum.added",
+	"TCP::O::SCPSCapabilities":                "tcp.option.scps-capabilities.added",
+	"TCP::O::TCPAlternateChecksumData":        "tcp.option.rfc1146.data.added",
+	"TCP::O::PartialOrderServiceProfile":      "tcp.option.rfc1693.profile.added",
+	"TCP::O::SelectiveNegativeAck":            "tcp.option.selective-nack.added",
+	"TCP::O::RecordBoundaries":                "tcp.option.record-boundaries.added",
+	"TCP::O::MultipathTCP":                    "tcp.option.mptcp.added",
+	"TCP::O::CorruptionExperienced":           "tcp.option.corruption-experienced.added",
+}
+
+// tbDelToCond maps the names of header fields that tracebox reports as
+// deleted somewhere along the path to PTO conditions. As with additions,
+// only TCP options can be stripped.
+var tbDelToCond = map[string]string{
+	"TCP::O::MSS":                             "tcp.option.mss.stripped",
+	"TCP::O::SACKPermitted":                   "tcp.option.sackok.stripped",
+	"TCP::O::WSOPT-WindowScale":               "tcp.option.ws.stripped",
+	"TCP::O::TSOPT-TimeStampOption":           "tcp.option.ts.stripped",
+	"TCP::O::TCPAuthenticationOption":         "tcp.option.ao.stripped",
+	"TCP::O::Echo":                            "tcp.option.rfc1072.echo.stripped",
+	"TCP::O::CC":                              "tcp.option.rfc1644.cc.stripped",
+	"TCP::O::CC.ECHO":                         "tcp.option.rfc1644.echo.stripped",
+	"TCP::O::MD5SignatureOption":              "tcp.option.md5.stripped",
+	"TCP::O::CC.NEW":                          "tcp.option.rfc1644.new.stripped",
+	"TCP::O::Quick-StartResponse":             "tcp.option.rfc4782.stripped",
+	"TCP::O::EchoReply":                       "tcp.option.rfc1072.reply.stripped",
+	"TCP::O::PartialOrderConnectionPermitted": "tcp.option.rfc1693.permitted.stripped",
+	"TCP::O::TCPAlternateChecksumRequest":     "tcp.option.rfc1146.request.stripped",
+	"TCP::O::SACK":                            "tcp.option.sack.stripped",
+	"TCP::O::SNAP":                            "tcp.option.snap.stripped",
+	"TCP::O::UserTimeoutOption":               "tcp.option.user-timeout.stripped",
+	"TCP::O::TrailerChecksumOption":           "tcp.option.trailer-checksum.stripped",
+	"TCP::O::SCPSCapabilities":                "tcp.option.scps-capabilities.stripped",
+	"TCP::O::TCPAlternateChecksumData":        "tcp.option.rfc1146.data.stripped",
+	"TCP::O::PartialOrderServiceProfile":      "tcp.option.rfc1693.profile.stripped",
+	"TCP::O::SelectiveNegativeAck":            "tcp.option.selective-nack.stripped",
+	"TCP::O::RecordBoundaries":                "tcp.option.record-boundaries.stripped",
+	"TCP::O::MultipathTCP":                    "tcp.option.mptcp.stripped",
+	"TCP::O::CorruptionExperienced":           "tcp.option.corruption-experienced.stripped",
+}
+
+// tbReasonToCond maps the reason why tracebox stopped probing to connectivity
+// conditions. Reasons not in this table don't give an observation. Only
+// tcp-rst is in here, since it's the only reason in the tracebox data we
+// have; add other reasons once it's known how tracebox writes them.
+var tbReasonToCond = map[string]string{
+	"tcp-rst": "tracebox.reached.rst",
 }
 
-type tbHop struct {
-	Address       string      `json:"ha"`
-	TTL           int         `json:"t"`
-	ICMPQuotation int         `json:"i"`
-	Modifications []nameValue `json:"m"`
-	Additions     []nameValue `json:"a"`
-	Deletions     []nameValue `json:"d"`
+// quotationClassPrefix is the prefix of the conditions for the ICMP
+// quotation class that tracebox records for each hop ("i"), for example
+// icmp.quotation.class.2; see tracebox.Hop. The conditions are named after
+// the raw class, since we don't know tracebox's definition of the classes.
+const quotationClassPrefix = "icmp.quotation.class."
+
+// quotationDependent is the condition that flags a change that tracebox
+// could only see because the router quoted more than RFC 792 requires.
+// Its value is the condition of the change.
+const quotationDependent = "icmp.quotation.needed"
+
+// ttlSeparator separates the value of a change from the TTL at which the
+// change was first seen, for example 0x5b4->0x564@4. Since missing hops are
+// filled in (see fillTTLGaps), this makes the location of a change
+// comparable across traces.
+const ttlSeparator = "@"
+
+// quotes returns true if the hop h of a trace to dst is a router that
+// responded, and therefore should have quoted the probe.
+func quotes(h *tracebox.Hop, dst string) bool {
+	return h.Address != "*" && !tracebox.SameAddress(h.Address, dst)
 }
 
-type tbObs struct {
-	Dst       string   `json:"dst"`
-	Reason    string   `json:"r"`
-	Timestamp int64    `json:"s"`
-	Hops      []*tbHop `json:"h"`
+// needsFullQuotation returns true if the field with the tracebox name name
+// lies beyond the first 8 bytes of the TCP header, which is all an RFC 792
+// quotation contains.
+func needsFullQuotation(name string) bool {
+	switch name {
+	case "TCP::SPort", "TCP::DPort", "TCP::SeqNumber":
+		return false
+	}
+	return strings.HasPrefix(name, "TCP::")
 }
 
 const metadataURL = "https://raw.githubusercontent.com/mami-project/pto3-trace/" +
@@ -119,7 +215,13 @@ const metadataURL = "https://raw.githubusercontent.com/mami-project/pto3-trace/"
 
 var (
 	numUnmarshallers = flag.Int("num-unmarshallers", 8, "number of goroutines used to unmarshal.")
-	chSize           = flag.Int("ch-size", 8192, "size of channels used to communicate between goroutines.")
+	onError          = flag.String("on-error", onErrorAbort, "what to do with records that can't be normalized: abort, skip, or quarantine.")
+	quarantineFile   = flag.String("quarantine-file", "pto3-trace-quarantine.ndjson", "file for quarantined records.")
+	icmpQuotation    = flag.Bool("icmp-quotation", false, "emit ICMP quotation observations for every hop and flag changes that depend on them.")
+	changeTTL        = flag.Bool("change-ttl", false, "append the TTL at which each change was first seen to its value, as in 0x564@4.")
+	pathMode         = flag.String("path-mode", pathModeAbbreviated, "how to write paths for changes: abbreviated, full, or segment.")
+	validate         = flag.Bool("validate", false, "reject records that fail the checks of the tracebox package, not just those that can't be normalized.")
+	conditionsFile   = flag.String("conditions", "", "JSON file with the tracebox to PTO condition mapping (default compiled-in table)")
 )
 
 func usage() {
@@ -155,8 +257,26 @@ func makeDSCPCondition(old string) *pto3.Condition {
 	return &pto3.Condition{Name: name}
 }
 
+// parseHex parses a value as tracebox writes it, i.e., in hex without a
+// leading "0x". Presumed values in the metadata may have a leading "0x".
+func parseHex(val string) (int64, error) {
+	return strconv.ParseInt(strings.TrimPrefix(val, "0x"), 16, 64)
+}
+
+// sameValue returns true if a and b are the same value. Presumed values in
+// the metadata are written like "0x5b4" where tracebox writes "05b4", so
+// values are compared as numbers if they are numbers.
+func sameValue(a, b string) bool {
+	na, erra := parseHex(a)
+	nb, errb := parseHex(b)
+	if erra != nil || errb != nil {
+		return a == b
+	}
+	return na == nb
+}
+
 func makeChange(new string, toDec bool) string {
-	num, err := strconv.ParseInt(new, 16, 64)
+	num, err := parseHex(new)
 	if err != nil {
 		num, err = strconv.ParseInt(new, 10, 64)
 		if err != nil {
@@ -169,244 +289,344 @@ func makeChange(new string, toDec bool) string {
 	return fmt.Sprintf("0x%x", num)
 }
 
-func appendObservation(o []pto3.Observation, start *time.Time, path *pto3.Path, cname string, new string) []pto3.Observation {
-	return append(o, makeTbObs(start, path, makeCondition(cname), makeChange(new, false)))
+// makeFromTo returns the value for a change from old to new, for example
+// "0x5b4->0x564". If old isn't known, it returns just the new value.
+func makeFromTo(old string, new string, toDec bool) string {
+	if old == "" {
+		return makeChange(new, toDec)
+	}
+	return makeChange(old, toDec) + "->" + makeChange(new, toDec)
+}
+
+func appendObservation(o []pto3.Observation, start *time.Time, path *pto3.Path, cname string, old string, new string, toDec bool) []pto3.Observation {
+	return append(o, makeTbObs(start, path, makeCondition(cname), makeFromTo(old, new, toDec)))
+}
+
+func toDecString(val string) (string, error) {
+	num, err := parseHex(val)
+	if err != nil {
+		return "", fmt.Errorf("can't convert \"%s\" to decimal", val)
+	}
+
+	return fmt.Sprintf("%d", num), nil
 }
 
-func toDecString(val string) string {
-	num, err := strconv.ParseInt(val, 16, 64)
+// appendDSCPObservation appends the change of the DSCP from old to new. The
+// condition says what the DSCP was changed from, as in dscp.10.changed, and
+// the value is "old->new" in decimal.
+func appendDSCPObservation(o []pto3.Observation, start *time.Time, path *pto3.Path, old, new string) ([]pto3.Observation, error) {
+	oldDec, err := toDecString(old)
 	if err != nil {
-		panic("can't convert string to decimal")
+		return o, err
+	}
+	if _, err := toDecString(new); err != nil {
+		return o, err
 	}
 
-	return fmt.Sprintf("%d", num)
+	return append(o, makeTbObs(start, path, makeDSCPCondition(oldDec), makeFromTo(old, new, true))), nil
 }
 
-func appendDSCPObservation(o []pto3.Observation, start *time.Time, path *pto3.Path, old, new string) []pto3.Observation {
-	oldDec := toDecString(old)
-	newDec := toDecString(new)
+// appendChangeDetails adds what goes with the change of the tracebox name
+// name at hop h, which must be the last observation in o: with -change-ttl,
+// the TTL at which the change was first seen goes into its value, and with
+// -icmp-quotation, an observation says whether seeing the change needed more
+// than an RFC 792 quotation.
+func appendChangeDetails(o []pto3.Observation, start *time.Time, path *pto3.Path, h *tracebox.Hop, name string) []pto3.Observation {
+	change := &o[len(o)-1]
+
+	if *changeTTL {
+		change.Value += ttlSeparator + strconv.Itoa(h.TTL)
+	}
+	if *icmpQuotation && needsFullQuotation(name) {
+		o = append(o, makeTbObs(start, path, makeCondition(quotationDependent), change.Condition.Name))
+	}
 
-	return append(o, makeTbObs(start, path, makeDSCPCondition(oldDec), makeChange(newDec, true)))
+	return o
 }
 
-func extractTraceboxV1Observations(srcIP string, tcpDestPort string, tbobs *tbObs) ([]pto3.Observation, error) {
+func extractTraceboxV1Observations(srcIP string, tcpDestPort string, tbobs *tracebox.Trace) ([]pto3.Observation, error) {
+	return extractObservations(srcIP, tcpDestPort, tbobs, nil)
+}
+
+// extractObservations extracts observations from tbobs. The header fields
+// of the probe, if known, are in probe. A change of a field whose previous
+// value is known has the value "old->new".
+func extractObservations(srcIP string, tcpDestPort string, tbobs *tracebox.Trace, probe []tracebox.NameValue) ([]pto3.Observation, error) {
+	// Hops we can't make sense of get the record rejected instead of
+	// taking down the whole run.
+	if err := tbobs.CheckHops(); err != nil {
+		return nil, err
+	}
+
 	var ret = make([]pto3.Observation, 4)[0:0]
 	start := time.Unix(tbobs.Timestamp, 0)
+	target := makeTarget(tbobs.Dst, tcpDestPort)
+
+	// Indices into the hops have to correspond to TTLs for the paths
+	// to show where hops are missing.
+	tbobs = fillTTLGaps(tbobs)
 
 	var values = make(map[string]string)
+	var added = make(map[string]string)
+	var deleted = make(map[string]bool)
+
+	for _, nv := range probe {
+		values[nv.Name] = nv.Value
+	}
 
 	for i, h := range tbobs.Hops {
 		var path *pto3.Path
 
 		for _, m := range h.Modifications {
-			if ptoCond, ok := tbToCond[m.Name]; ok {
-				if stored, ok := values[m.Name]; !ok || m.Value != stored {
-					path = makePathForChange(path, srcIP, tbobs, i)
-					if ptoCond == dscpChanged {
-						if !ok { // unknown DSCP value, we assume 0
-							stored = "0"
+			if cm, ok := conds[m.Name]; ok && cm.Changed != "" {
+				if stored, ok := values[m.Name]; !ok || !sameValue(m.Value, stored) {
+					if cm.Changed == dscpChanged && !ok {
+						// Without the original DSCP, there's no telling
+						// which dscp.<old>.changed this is. Remember the
+						// value, so that further changes are reported.
+						if _, err := toDecString(m.Value); err != nil {
+							return nil, fmt.Errorf("bad DSCP value: %v", err)
+						}
+						values[m.Name] = m.Value
+						continue
+					}
+					path = makePathForMode(path, *pathMode, srcIP, target, tbobs, i)
+					if cm.Changed == dscpChanged {
+						var err error
+						if ret, err = appendDSCPObservation(ret, &start, path, stored, m.Value); err != nil {
+							return nil, fmt.Errorf("bad DSCP value: %v", err)
 						}
-						ret = appendDSCPObservation(ret, &start, path, stored, m.Value)
 					} else {
-						ret = appendObservation(ret, &start, path, ptoCond, m.Value)
+						ret = appendObservation(ret, &start, path, cm.Changed, stored, m.Value, cm.decimal())
 					}
+					ret = appendChangeDetails(ret, &start, path, h, m.Name)
 					values[m.Name] = m.Value
 				}
 			}
 		}
-	}
-
-	return ret, nil
-}
 
-// Reads lines from the srcCh, unmarshalls it and invokes the extraction function
-// and sends the result to dstCh.
-// If done (when srcCh is closed) will send true on doneCh.
-func unmarshaller(srcCh chan line, dstCh chan []pto3.Observation,
-	extractFunc func(string, string, *tbObs) ([]pto3.Observation, error),
-	srcIP, tcpDestPort string, doneCh chan bool) {
-
-	for {
-		lineUntrimmed, ok := <-srcCh
-		line := trace.TrimSpace(lineUntrimmed.b)
-
-		if !ok {
-			break
+		// Tracebox reports an addition at every hop after the one where
+		// it first appeared, so as with modifications we only report it
+		// when it's new or its value has changed.
+		for _, a := range h.Additions {
+			if cm, ok := conds[a.Name]; ok && cm.Added != "" {
+				if stored, ok := added[a.Name]; !ok || a.Value != stored {
+					path = makePathForMode(path, *pathMode, srcIP, target, tbobs, i)
+					ret = appendObservation(ret, &start, path, cm.Added, stored, a.Value, cm.decimal())
+					ret = appendChangeDetails(ret, &start, path, h, a.Name)
+					added[a.Name] = a.Value
+				}
+			}
 		}
 
-		var tbobs tbObs
-
-		if err := jsoniter.Unmarshal(line, &tbobs); err != nil {
-			panic(fmt.Sprintf("line %d: %v", lineUntrimmed.n, err))
+		// A stripped option stays stripped, so we report it only at the
+		// hop where the deletion first shows up.
+		for _, d := range h.Deletions {
+			if cm, ok := conds[d.Name]; ok && cm.Stripped != "" && !deleted[d.Name] {
+				path = makePathForMode(path, *pathMode, srcIP, target, tbobs, i)
+				ret = appendObservation(ret, &start, path, cm.Stripped, "", d.Value, cm.decimal())
+				ret = appendChangeDetails(ret, &start, path, h, d.Name)
+				deleted[d.Name] = true
+			}
 		}
 
-		obsen, err := extractFunc(srcIP, tcpDestPort, &tbobs)
-
-		if err != nil {
-			panic(fmt.Sprintf("line %d: %v", lineUntrimmed.n, err))
+		if *icmpQuotation && quotes(h, tbobs.Dst) {
+			class := strconv.Itoa(h.ICMPQuotation)
+			hopPath := makeHopPath(srcIP, target, tbobs, i)
+			ret = append(ret, makeTbObs(&start, hopPath, makeCondition(quotationClassPrefix+class), class))
 		}
+	}
 
-		dstCh <- obsen
+	// Whether the destination was reached at all is a property of the
+	// whole path, not of any particular hop.
+	if ptoCond, ok := tbReasonToCond[tbobs.Reason]; ok {
+		path := makeFullPath(srcIP, target, tbobs)
+		ret = append(ret, makeTbObs(&start, path, makeCondition(ptoCond), tbobs.Reason))
 	}
 
-	doneCh <- true
+	return ret, nil
 }
 
-func copyLine(line []byte) []byte {
-	ret := make([]byte, len(line))
-	copy(ret, line)
-
-	return ret
+// fileInfo is what we know about a raw file from its metadata.
+type fileInfo struct {
+	srcIP       string
+	tcpDestPort string
+	presumed    []tracebox.NameValue // presumed header fields of all probes
 }
 
-type line struct {
-	b []byte // bytes comprising the line
-	n int    // line number
+// presumedFields maps the metadata keys for the presumed header fields of
+// the probes in a campaign to the tracebox names of those fields. Tracebox v1
+// doesn't record what it sent, so without these we don't know what a field
+// was changed from. They are written by pto3-trace-mkmeta.
+var presumedFields = []struct {
+	key  string
+	name string
+}{
+	{"presumed_tcp_flags", "TCP::Flags"},
+	{"presumed_dscp", "IP::DiffServicesCP"},
+	{"presumed_tcp_window", "TCP::Window"},
+	{"presumed_tcp_mss", "TCP::O::MSS"},
 }
 
-func normalizeTrace(rawBytes []byte, metain io.Reader, out io.Writer) error {
-	md, err := pto3.RawMetadataFromReader(metain, nil)
-	if err != nil {
-		return fmt.Errorf("could not read metadata: %v", err)
+// fileInfoFromMetadata returns what the metadata md says about a raw file. It
+// returns an error if a presumed header field isn't a hex number.
+func fileInfoFromMetadata(md *pto3.RawMetadata) (*fileInfo, error) {
+	ret := &fileInfo{
+		srcIP:       md.Get("src_ip", true),
+		tcpDestPort: md.Get("tcp_dst_port", true),
 	}
 
-	var srcIP = md.Get("src_ip", true)
-	var tcpDestPort = md.Get("tcp_dst_port", true)
-	var in = bytes.NewReader(rawBytes)
-	var scanner *bufio.Scanner
-	var extractFunc func(string, string, *tbObs) ([]pto3.Observation, error)
-
-	switch md.Filetype(true) {
-	case "tracebox-v1-ndjson":
-		scanner = bufio.NewScanner(in)
-		extractFunc = extractTraceboxV1Observations
-	default:
-		return fmt.Errorf("unsupported filetype %s", md.Filetype(true))
+	for _, pf := range presumedFields {
+		if v := md.Get(pf.key, true); v != "" {
+			if _, err := parseHex(v); err != nil {
+				return nil, fmt.Errorf("%s: \"%s\" isn't a hex number", pf.key, v)
+			}
+			ret.presumed = append(ret.presumed, tracebox.NameValue{Name: pf.name, Value: v})
+		}
 	}
 
-	conditions := make(map[string]bool)
-
-	srcCh := make(chan line, *chSize)
-	dstCh := make(chan []pto3.Observation, *chSize)
-	doneCh := make(chan bool)
+	return ret, nil
+}
 
-	doneChans := make([]chan bool, *numUnmarshallers)
+// fileInfos caches the fileInfo for the metadata of each raw file. The
+// normalizer hands the same metadata to every record of a file, so this
+// way the metadata is only looked at once.
+var fileInfos = struct {
+	sync.Mutex
+	m map[*pto3.RawMetadata]*fileInfo
+}{m: make(map[*pto3.RawMetadata]*fileInfo)}
+
+// cachedFileInfo returns the fileInfo for md, reading it from md the first
+// time. Errors aren't cached; they abort normalization anyway.
+func cachedFileInfo(md *pto3.RawMetadata) (*fileInfo, error) {
+	fileInfos.Lock()
+	defer fileInfos.Unlock()
+
+	if fi, ok := fileInfos.m[md]; ok {
+		return fi, nil
+	}
 
-	for i := 0; i < *numUnmarshallers; i++ {
-		doneChans[i] = make(chan bool)
-		go unmarshaller(srcCh, dstCh, extractFunc, srcIP, tcpDestPort, doneChans[i])
+	fi, err := fileInfoFromMetadata(md)
+	if err != nil {
+		return nil, err
 	}
+	fileInfos.m[md] = fi
 
-	// Spawn a goroutine to collect observations
-	// and write them to out.
-	go func() {
-		for {
-			obsen, ok := <-dstCh
+	return fi, nil
+}
 
-			if !ok {
-				break
-			}
+// decodeFunc decodes a record and extracts observations from it. It also
+// returns the trace for the run statistics.
+type decodeFunc func(fi *fileInfo, line []byte) (*tracebox.Trace, []pto3.Observation, error)
 
-			for _, o := range obsen {
-				conditions[o.Condition.Name] = true
-			}
+func decodeV1(fi *fileInfo, line []byte) (*tracebox.Trace, []pto3.Observation, error) {
+	var tbobs tracebox.Trace
 
-			if err := pto3.WriteObservations(obsen, out); err != nil {
-				panic(err.Error())
-			}
+	if err := tracebox.Unmarshal(line, &tbobs); err != nil {
+		return nil, nil, err
+	}
+	if *validate {
+		if err := tbobs.Validate(); err != nil {
+			return nil, nil, err
 		}
+	}
 
-		doneCh <- true
-	}()
-
-	var lineno int
+	obsen, err := extractObservations(fi.srcIP, fi.tcpDestPort, &tbobs, fi.presumed)
 
-	// Split the input into lines and distribute the lines
-	// among the unmarshallers.
-	for scanner.Scan() {
-		lineno++
-		origLine := scanner.Bytes()
+	return &tbobs, obsen, err
+}
 
-		if origLine[0] != '{' {
-			continue
-		}
+// probeTypeFlags maps the probe types of v2 traces to the TCP flags of the
+// probes. A v2 trace needn't list the flags of its probe, but a change of
+// the flags of an ECN-setup SYN means something else than one of a plain
+// SYN, so this way the value of the change says which it was. Data probes
+// have no fixed flags.
+var probeTypeFlags = map[string]string{
+	tracebox.ProbeSYN:      "02",
+	tracebox.ProbeECNSetup: "c2",
+}
 
-		// This is NECESSARY because Scanner internally
-		// reuses the buffer when calling `Scan`. This means
-		// we need to copy the buffer.
-		myLine := copyLine(origLine)
+// decodeV2 decodes a v2 trace. Unlike v1 traces, these come with the header
+// fields of the probe, so there's no need to guess what a field was before
+// it was changed.
+func decodeV2(fi *fileInfo, line []byte) (*tracebox.Trace, []pto3.Observation, error) {
+	var tbobs tracebox.TraceV2
 
-		srcCh <- line{b: myLine, n: lineno}
+	if err := tracebox.UnmarshalV2(line, &tbobs); err != nil {
+		return nil, nil, err
 	}
-
-	// close the source channel to signal the unmarshallers
-	// to start stopping.
-	// The unmarshallers don't stop immediately of course as they might still be
-	// performing computations or the source channel still has buffered elements.
-	close(srcCh)
-
-	// wait for all unmarshallers to have finished their job
-	for i := 0; i < *numUnmarshallers; i++ {
-		_ = <-doneChans[i]
+	if *validate {
+		if err := tbobs.Validate(); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	// close the destination channel to send a stop signal to the
-	// collector goroutine.
-	close(dstCh)
+	// What the probe actually looked like beats what we presume.
+	probe := make([]tracebox.NameValue, 0, len(fi.presumed)+len(tbobs.Probe)+1)
+	probe = append(probe, fi.presumed...)
+	if flags, ok := probeTypeFlags[tbobs.ProbeType]; ok {
+		probe = append(probe, tracebox.NameValue{Name: "TCP::Flags", Value: flags})
+	}
+	probe = append(probe, tbobs.Probe...)
 
-	// wait for the collector goroutine to have actually stopped.
-	_ = <-doneCh
+	obsen, err := extractObservations(fi.srcIP, fi.tcpDestPort, &tbobs.Trace, probe)
 
-	mdout := make(map[string]interface{})
-	mdcond := make([]string, 0)
+	return &tbobs.Trace, obsen, err
+}
 
-	for k := range md.Metadata {
-		mdout[k] = md.Metadata[k]
+// normalizeNDJSON normalizes one line of a tracebox NDJSON file, using decode
+// for the parts that depend on the tracebox version.
+func normalizeNDJSON(rec []byte, rawmeta *pto3.RawMetadata, metachan chan<- map[string]interface{}, decode decodeFunc) ([]pto3.Observation, error) {
+	if n, ok := endOfInput(rec); ok {
+		run.end(n, metachan)
+		return nil, nil
 	}
 
-	for k := range conditions {
-		mdcond = append(mdcond, k)
+	fi, err := cachedFileInfo(rawmeta)
+	if err != nil {
+		return nil, fmt.Errorf("bad metadata: %v", err)
 	}
-	mdout["_conditions"] = mdcond
 
-	mdout["_owner"] = md.Owner(true)
-	mdout["_time_start"] = md.TimeStart(true).Format(time.RFC3339)
-	mdout["_time_end"] = md.TimeEnd(true).Format(time.RFC3339)
+	lineno, rec := splitLineNumber(rec)
+	line := trace.TrimSpace(rec)
+
+	if len(line) == 0 || line[0] != '{' {
+		run.count(metachan, func(s *runStats) { s.read(true) })
+		return nil, nil
+	}
 
-	// hardcode analyzer path (FIXME, tag?)
-	mdout["_analyzer"] = metadataURL
+	tbobs, obsen, err := decode(fi, line)
 
-	bytes, err := jsoniter.Marshal(mdout)
 	if err != nil {
-		return fmt.Errorf("error marshaling metadata: %s", err.Error())
+		return nil, rejectRecord(lineno, line, err, metachan)
 	}
 
-	if _, err := fmt.Fprintf(out, "%s\n", bytes); err != nil {
-		return fmt.Errorf("error writing metadata: %s", err.Error())
-	}
+	run.count(metachan, func(s *runStats) {
+		s.read(false)
+		s.record(tbobs, obsen)
+	})
 
-	return nil
+	return obsen, nil
 }
 
 func normalizeV1(rec []byte, rawmeta *pto3.RawMetadata, metachan chan<- map[string]interface{}) ([]pto3.Observation, error) {
-	var srcIP = rawmeta.Get("src_ip", true)
-	var tcpDestPort = rawmeta.Get("tcp_dst_port", true)
-
-	var tbobs tbObs
+	return normalizeNDJSON(rec, rawmeta, metachan, decodeV1)
+}
 
-	line := trace.TrimSpace(rec)
+func normalizeV2(rec []byte, rawmeta *pto3.RawMetadata, metachan chan<- map[string]interface{}) ([]pto3.Observation, error) {
+	return normalizeNDJSON(rec, rawmeta, metachan, decodeV2)
+}
 
-	if err := jsoniter.Unmarshal(line, &tbobs); err != nil {
-		return nil, err
+// rejectRecord applies the error policy to a record that couldn't be
+// normalized and, unless we're aborting, counts it in the output metadata.
+func rejectRecord(lineno int, line []byte, err error, metachan chan<- map[string]interface{}) error {
+	if err := policy.reject(lineno, line, err); err != nil {
+		return err
 	}
 
-	obsen, err := extractTraceboxV1Observations(srcIP, tcpDestPort, &tbobs)
-
-	if err != nil {
-		return nil, err
-	}
+	run.count(metachan, func(s *runStats) { s.reject() })
 
-	return obsen, nil
+	return nil
 }
 
 func main() {
@@ -414,10 +634,40 @@ func main() {
 
 	flag.Parse()
 
+	var err error
+
+	if !validPathMode(*pathMode) {
+		log.Fatalf("unknown path mode %s", *pathMode)
+	}
+
+	if *conditionsFile != "" {
+		if conds, err = loadCondTable(*conditionsFile); err != nil {
+			log.Fatalf("can't load conditions: %v", err)
+		}
+	}
+
+	if policy, err = newErrorPolicy(*onError, *quarantineFile); err != nil {
+		log.Fatal(err)
+	}
+
 	mdfile := os.NewFile(3, ".piped_metadata.json")
 
 	sn := pto3.NewParallelScanningNormalizer(metadataURL, *numUnmarshallers)
-	sn.RegisterFiletype("tracebox-v1-ndjson", bufio.ScanLines, normalizeV1, nil)
+	sn.RegisterFiletype("tracebox-v1-ndjson", scanNumberedLines(), normalizeV1, mergeRunStats)
+	sn.RegisterFiletype("tracebox-v2-ndjson", scanNumberedLines(), normalizeV2, mergeRunStats)
 
-	log.Fatal(sn.Normalize(os.Stdin, mdfile, os.Stdout))
+	in, err := openInput(os.Stdin)
+	if err != nil {
+		log.Fatalf("can't read input: %v", err)
+	}
+
+	err = sn.Normalize(in, mdfile, os.Stdout)
+
+	if cerr := policy.close(); cerr != nil {
+		log.Printf("can't close quarantine file: %v", cerr)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	pto3 "github.com/mami-project/pto3-go"
+	"github.com/mami-project/pto3-trace/tracebox"
+)
+
+const mssAdded = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "i":2, "m":[], "a":[], "d":[]},{"ha":"128.112.12.57", "t":2, "i":3, "m":[], "a":[{"n":"TCP::O::MSS", "v":"0564"}], "d":[]},{"ha":"128.112.12.142", "t":3, "i":3, "m":[], "a":[{"n":"TCP::O::MSS", "v":"0564"}], "d":[]},{"ha":"63.138.53.73", "t":4, "i":2, "m":[], "a":[], "d":[]}]}`
+
+func findObservation(obsen []pto3.Observation, cond string) *pto3.Observation {
+	for i := range obsen {
+		if obsen[i].Condition.Name == cond {
+			return &obsen[i]
+		}
+	}
+	return nil
+}
+
+func testObservationCount(t *testing.T, obsen []pto3.Observation, cond string, want int) {
+	var got int
+	for _, o := range obsen {
+		if o.Condition.Name == cond {
+			got++
+		}
+	}
+	if got != want {
+		t.Errorf("condition %s: want %d observations, got %d", cond, want, got)
+	}
+}
+
+func TestExtractAdditions(t *testing.T) {
+	obsen, err := extractTraceboxV1Observations(src, "80", tbObsFromString(mssAdded))
+	if err != nil {
+		t.Fatalf("can't extract observations: %v", err)
+	}
+
+	testObservationCount(t, obsen, "tcp.option.mss.added", 1)
+
+	o := findObservation(obsen, "tcp.option.mss.added")
+	if o == nil {
+		return
+	}
+	testPathsEquals(t, "128.112.139.42 128.112.139.1 128.112.12.57 * 88.212.202.2:80", o.Path.String)
+	if o.Value != "0x564" {
+		t.Errorf("want value 0x564, got %s", o.Value)
+	}
+}
+
+const sackStripped = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "i":2, "m":[], "a":[], "d":[]},{"ha":"128.112.12.57", "t":2, "i":2, "m":[], "a":[], "d":[]},{"ha":"128.112.12.142", "t":3, "i":3, "m":[], "a":[], "d":[{"n":"TCP::O::SACKPermitted", "v":""}]},{"ha":"63.138.53.73", "t":4, "i":3, "m":[], "a":[], "d":[{"n":"TCP::O::SACKPermitted", "v":""}]},{"ha":"67.151.33.22", "t":5, "i":3, "m":[], "a":[], "d":[{"n":"TCP::O::SACKPermitted", "v":""}]}]}`
+
+func TestExtractDeletions(t *testing.T) {
+	obsen, err := extractTraceboxV1Observations(src, "80", tbObsFromString(sackStripped))
+	if err != nil {
+		t.Fatalf("can't extract observations: %v", err)
+	}
+
+	testObservationCount(t, obsen, "tcp.option.sackok.stripped", 1)
+
+	if o := findObservation(obsen, "tcp.option.sackok.stripped"); o != nil {
+		testPathsEquals(t, "128.112.139.42 * 128.112.12.57 128.112.12.142 * 88.212.202.2:80", o.Path.String)
+	}
+}
+
+func TestExtractIPv6(t *testing.T) {
+	obsen, err := extractTraceboxV1Observations(src6, "443", tbObsFromString(longPath6))
+	if err != nil {
+		t.Fatalf("can't extract observations: %v", err)
+	}
+
+	testObservationCount(t, obsen, "ip6.flowlabel.changed", 1)
+
+	if o := findObservation(obsen, "ip6.flowlabel.changed"); o != nil {
+		testPathsEquals(t, "2001:db8:1::42 2001:db8:1::1 2001:db8:2::1 * [2001:db8:ff::2]:443", o.Path.String)
+	}
+}
+
+func TestExtractWithoutPort(t *testing.T) {
+	obsen, err := extractTraceboxV1Observations(src, "", tbObsFromString(mssAdded))
+	if err != nil {
+		t.Fatalf("can't extract observations: %v", err)
+	}
+
+	if o := findObservation(obsen, "tcp.option.mss.added"); o != nil {
+		testPathsEquals(t, "128.112.139.42 128.112.139.1 128.112.12.57 * 88.212.202.2", o.Path.String)
+	}
+}
+
+func TestRunStatsMerge(t *testing.T) {
+	acc := make(map[string]interface{})
+
+	for _, s := range []string{mssAdded, sackStripped, noPath} {
+		tbobs := tbObsFromString(s)
+		obsen, err := extractTraceboxV1Observations(src, "80", tbobs)
+		if err != nil {
+			t.Fatalf("can't extract observations: %v", err)
+		}
+
+		stats := newRunStats()
+		stats.read(false)
+		stats.record(tbobs, obsen)
+		md := make(map[string]interface{})
+		stats.addTo(md)
+		mergeRunStats(md, acc)
+	}
+
+	if acc["records_read"] != 3 || acc["traces_without_hops"] != 1 {
+		t.Errorf("unexpected record counts in %v", acc)
+	}
+	if n := acc["observation_counts"].(map[string]int)["tcp.option.sackok.stripped"]; n != 1 {
+		t.Errorf("want 1 tcp.option.sackok.stripped, got %d", n)
+	}
+	if n := acc["hop_counts"].(map[string]int)["5"]; n != 1 {
+		t.Errorf("want 1 trace with 5 hops, got %d", n)
+	}
+	if _, ok := acc["elapsed"]; !ok {
+		t.Errorf("no elapsed time in %v", acc)
+	}
+}
+
+func TestExtractReason(t *testing.T) {
+	obsen, err := extractTraceboxV1Observations(src, "80", tbObsFromString(longPathStarMiddle))
+	if err != nil {
+		t.Fatalf("can't extract observations: %v", err)
+	}
+
+	testObservationCount(t, obsen, "tracebox.reached.rst", 1)
+
+	if o := findObservation(obsen, "tracebox.reached.rst"); o != nil {
+		testPathsEquals(t, "128.112.139.42 128.112.139.1 128.112.12.57 128.112.12.142 63.138.53.73 67.151.33.22 63.138.198.162 213.248.95.21 62.115.112.248 62.115.141.96 62.115.139.166 62.115.116.233 * 88.212.194.82 88.212.202.2:80", o.Path.String)
+	}
+
+	obsen, err = extractTraceboxV1Observations(src, "", tbObsFromString(noPath))
+	if err != nil {
+		t.Fatalf("can't extract observations: %v", err)
+	}
+	if o := findObservation(obsen, "tracebox.reached.rst"); o == nil {
+		t.Errorf("no connectivity observation for trace without hops")
+	} else {
+		testPathsEquals(t, "128.112.139.42 88.212.202.2", o.Path.String)
+	}
+}
+
+func TestExtractQuotation(t *testing.T) {
+	const mssChanged = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "i":1, "m":[], "a":[], "d":[]},{"ha":"128.112.12.57", "t":2, "i":2, "m":[{"n":"TCP::O::MSS", "v":"0564"}, {"n":"IP::DiffServicesCP", "v":"08"}], "a":[], "d":[]},{"ha":"*", "t":3, "i":0, "m":[], "a":[], "d":[]},{"ha":"63.138.53.73", "t":4, "i":3, "m":[{"n":"TCP::O::MSS", "v":"0564"}], "a":[], "d":[]},{"ha":"88.212.202.2", "t":5, "i":0, "m":[], "a":[], "d":[]}]}`
+
+	*icmpQuotation = true
+	defer func() { *icmpQuotation = false }()
+
+	obsen, err := extractTraceboxV1Observations(src, "", tbObsFromString(mssChanged))
+	if err != nil {
+		t.Fatalf("can't extract observations: %v", err)
+	}
+
+	testObservationCount(t, obsen, "icmp.quotation.class.1", 1)
+	testObservationCount(t, obsen, "icmp.quotation.class.2", 1)
+	testObservationCount(t, obsen, "icmp.quotation.class.3", 1)
+	testObservationCount(t, obsen, "icmp.quotation.class.0", 0)
+	testObservationCount(t, obsen, quotationDependent, 1)
+
+	if o := findObservation(obsen, "icmp.quotation.class.2"); o != nil {
+		testPathsEquals(t, "128.112.139.42 * 128.112.12.57 * 88.212.202.2", o.Path.String)
+	}
+	if o := findObservation(obsen, "icmp.quotation.class.3"); o != nil {
+		testPathsEquals(t, "128.112.139.42 * 63.138.53.73 88.212.202.2", o.Path.String)
+	}
+	if o := findObservation(obsen, quotationDependent); o != nil && o.Value != "tcp.option.mss.changed" {
+		t.Errorf("want quotation dependency for tcp.option.mss.changed, got %s", o.Value)
+	}
+}
+
+func TestExtractChangeTTL(t *testing.T) {
+	*changeTTL = true
+	defer func() { *changeTTL = false }()
+
+	obsen, err := extractTraceboxV1Observations(src, "", tbObsFromString(gapPath))
+	if err != nil {
+		t.Fatalf("can't extract observations: %v", err)
+	}
+
+	testObservationCount(t, obsen, "tcp.option.mss.changed", 1)
+	testObservationCount(t, obsen, "tcp.option.mss.changed.ttl", 0)
+
+	if o := findObservation(obsen, "tcp.option.mss.changed"); o != nil {
+		if o.Value != "0x564@4" {
+			t.Errorf("want value 0x564@4, got %s", o.Value)
+		}
+		testPathsEquals(t, "128.112.139.42 * 63.138.53.73 * 88.212.202.2", o.Path.String)
+	}
+}
+
+func TestExtractV2(t *testing.T) {
+	const v2 = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "pt":"syn", "p":[{"n":"IP::DiffServicesCP", "v":"0a"}, {"n":"TCP::O::MSS", "v":"05b4"}], "h":[{"ha":"128.112.139.1", "t":1, "i":2, "m":[{"n":"IP::DiffServicesCP", "v":"1a"}], "a":[], "d":[]},{"ha":"128.112.12.57", "t":2, "i":2, "m":[{"n":"IP::DiffServicesCP", "v":"00"}, {"n":"TCP::O::MSS", "v":"0564"}], "a":[], "d":[]}]}`
+
+	_, obsen, err := decodeV2(&fileInfo{srcIP: src}, []byte(v2))
+	if err != nil {
+		t.Fatalf("can't extract observations: %v", err)
+	}
+
+	testObservationCount(t, obsen, "dscp.10.changed", 1)
+	testObservationCount(t, obsen, "dscp.26.changed", 1)
+	testObservationCount(t, obsen, "dscp.0.changed", 0)
+	testObservationCount(t, obsen, "tcp.option.mss.changed", 1)
+
+	if o := findObservation(obsen, "dscp.10.changed"); o != nil && o.Value != "10->26" {
+		t.Errorf("want value 10->26, got %s", o.Value)
+	}
+	if o := findObservation(obsen, "dscp.26.changed"); o != nil && o.Value != "26->0" {
+		t.Errorf("want value 26->0, got %s", o.Value)
+	}
+
+	if o := findObservation(obsen, "tcp.option.mss.changed"); o != nil {
+		if o.Value != "0x5b4->0x564" {
+			t.Errorf("want value 0x5b4->0x564, got %s", o.Value)
+		}
+	}
+}
+
+func TestUnknownDSCP(t *testing.T) {
+	const v1 = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "i":2, "m":[{"n":"IP::DiffServicesCP", "v":"08"}], "a":[], "d":[]},{"ha":"128.112.12.57", "t":2, "i":2, "m":[{"n":"IP::DiffServicesCP", "v":"1a"}], "a":[], "d":[]}]}`
+
+	// The first change has no known original, so only the second one,
+	// from what the first hop saw, is reported.
+	obsen, err := extractTraceboxV1Observations(src, "", tbObsFromString(v1))
+	if err != nil {
+		t.Fatalf("can't extract observations: %v", err)
+	}
+
+	testObservationCount(t, obsen, "dscp.0.changed", 0)
+	testObservationCount(t, obsen, "dscp.8.changed", 1)
+
+	if o := findObservation(obsen, "dscp.8.changed"); o != nil && o.Value != "8->26" {
+		t.Errorf("want value 8->26, got %s", o.Value)
+	}
+}
+
+func TestProbeType(t *testing.T) {
+	const ecnSetup = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "pt":"ecn-setup", "p":[], "h":[{"ha":"128.112.139.1", "t":1, "i":2, "m":[{"n":"TCP::Flags", "v":"02"}], "a":[], "d":[]}]}`
+
+	// The flags presumed from the metadata are those of a plain SYN, but
+	// the probe was an ECN-setup SYN.
+	fi := &fileInfo{srcIP: src, presumed: []tracebox.NameValue{{Name: "TCP::Flags", Value: "0x2"}}}
+	_, obsen, err := decodeV2(fi, []byte(ecnSetup))
+	if err != nil {
+		t.Fatalf("can't extract observations: %v", err)
+	}
+
+	if o := findObservation(obsen, "tcp.flags.changed"); o == nil {
+		t.Errorf("no flags change")
+	} else if o.Value != "0xc2->0x2" {
+		t.Errorf("want value 0xc2->0x2, got %s", o.Value)
+	}
+}
+
+func TestPresumedValues(t *testing.T) {
+	const v1 = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "m":[{"n":"TCP::O::MSS", "v":"0564"}, {"n":"TCP::Window", "v":"2000"}], "a":[], "d":[]}]}`
+
+	md, err := pto3.RawMetadataFromReader(strings.NewReader(`{"src_ip": "`+src+`", "presumed_tcp_mss": "0x5b4"}`), nil)
+	if err != nil {
+		t.Fatalf("can't read metadata: %v", err)
+	}
+
+	fi, err := fileInfoFromMetadata(md)
+	if err != nil {
+		t.Fatalf("can't get file info: %v", err)
+	}
+	if len(fi.presumed) != 1 {
+		t.Fatalf("want 1 presumed value, got %d", len(fi.presumed))
+	}
+
+	_, obsen, err := decodeV1(fi, []byte(v1))
+	if err != nil {
+		t.Fatalf("can't extract observations: %v", err)
+	}
+
+	if o := findObservation(obsen, "tcp.option.mss.changed"); o == nil {
+		t.Errorf("no MSS change")
+	} else if o.Value != "0x5b4->0x564" {
+		t.Errorf("want value 0x5b4->0x564, got %s", o.Value)
+	}
+
+	// No presumed window, so only the new value.
+	if o := findObservation(obsen, "tcp.window.changed"); o == nil {
+		t.Errorf("no window change")
+	} else if o.Value != "0x2000" {
+		t.Errorf("want value 0x2000, got %s", o.Value)
+	}
+
+	// The presumed value in tracebox's spelling is no change.
+	const same = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "m":[{"n":"TCP::O::MSS", "v":"05b4"}], "a":[], "d":[]}]}`
+	if _, obsen, err = decodeV1(fi, []byte(same)); err != nil {
+		t.Fatalf("can't extract observations: %v", err)
+	}
+	testObservationCount(t, obsen, "tcp.option.mss.changed", 0)
+}
+
+func TestBadPresumedValue(t *testing.T) {
+	md, err := pto3.RawMetadataFromReader(strings.NewReader(`{"src_ip": "`+src+`", "presumed_tcp_mss": "1460 bytes"}`), nil)
+	if err != nil {
+		t.Fatalf("can't read metadata: %v", err)
+	}
+
+	if _, err := fileInfoFromMetadata(md); err == nil {
+		t.Errorf("expected error for non-hex presumed value")
+	}
+}
+
+func TestRunCounter(t *testing.T) {
+	metachan := make(chan map[string]interface{}, 2)
+
+	// The end of the input can be seen before all records are counted.
+	c := newRunCounter()
+	c.count(metachan, func(s *runStats) { s.read(false) })
+	c.end(3, metachan)
+	c.count(metachan, func(s *runStats) { s.read(true) })
+	if len(metachan) != 0 {
+		t.Fatalf("statistics sent before all records were counted")
+	}
+	c.count(metachan, func(s *runStats) { s.reject() })
+
+	if len(metachan) != 1 {
+		t.Fatalf("want statistics sent once, got %d sends", len(metachan))
+	}
+	md := <-metachan
+	if md["records_read"] != 3 || md["records_skipped"] != 1 || md["rejected_lines"] != 1 {
+		t.Errorf("unexpected statistics %v", md)
+	}
+
+	// An empty input still gets statistics.
+	c = newRunCounter()
+	c.end(0, metachan)
+	if md := <-metachan; md["records_read"] != 0 {
+		t.Errorf("unexpected statistics %v", md)
+	}
+}
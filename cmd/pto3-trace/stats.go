@@ -0,0 +1,178 @@
+// Copyright 2018 Zurich University of Applied Sciences.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+	"github.com/mami-project/pto3-trace/tracebox"
+)
+
+// runStart is when the normalization run started.
+var runStart = time.Now()
+
+// runStats collects statistics about a normalization run. They end up in
+// the output metadata, so that a normalized file can be checked against
+// the raw file without another pass over the raw file.
+type runStats struct {
+	sync.Mutex
+	recordsRead       int
+	recordsSkipped    int
+	recordsRejected   int
+	tracesWithoutHops int
+	observations      map[string]int // number of observations per condition
+	hopCounts         map[string]int // number of traces per hop count
+}
+
+func newRunStats() *runStats {
+	return &runStats{
+		observations: make(map[string]int),
+		hopCounts:    make(map[string]int),
+	}
+}
+
+// read counts a record that was read from the input. Records that don't look
+// like JSON objects are skipped.
+func (s *runStats) read(skipped bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.recordsRead++
+	if skipped {
+		s.recordsSkipped++
+	}
+}
+
+// reject counts a record that couldn't be normalized.
+func (s *runStats) reject() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.recordsRead++
+	s.recordsRejected++
+}
+
+// record counts a trace and the observations extracted from it.
+func (s *runStats) record(tbobs *tracebox.Trace, obsen []pto3.Observation) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(tbobs.Hops) == 0 {
+		s.tracesWithoutHops++
+	}
+	s.hopCounts[strconv.Itoa(len(tbobs.Hops))]++
+
+	for _, o := range obsen {
+		s.observations[o.Condition.Name]++
+	}
+}
+
+// addTo adds the statistics to the metadata md.
+func (s *runStats) addTo(md map[string]interface{}) {
+	s.Lock()
+	defer s.Unlock()
+
+	md["records_read"] = s.recordsRead
+	md["records_skipped"] = s.recordsSkipped
+	md["rejected_lines"] = s.recordsRejected
+	md["traces_without_hops"] = s.tracesWithoutHops
+	md["observation_counts"] = s.observations
+	md["hop_counts"] = s.hopCounts
+}
+
+// runCounter collects the statistics of all records of a run in one
+// runStats and sends them to the metadata merger once all records have
+// been counted. Sending them for every record would mean an allocation and
+// a channel send per record, all for a single merging goroutine.
+//
+// The records are normalized in parallel, so the last record to be read
+// need not be the last to be counted. The split function marks the end of
+// the input with a token that says how many records there were (see
+// numbered), and the statistics are sent when that many have been counted.
+type runCounter struct {
+	sync.Mutex
+	stats   *runStats
+	counted int // records counted so far
+	total   int // records in the input, or -1 until the end is seen
+}
+
+func newRunCounter() *runCounter {
+	return &runCounter{stats: newRunStats(), total: -1}
+}
+
+// run counts the records of this run.
+var run = newRunCounter()
+
+// count counts a record with f and sends the statistics on metachan if it
+// was the last one.
+func (c *runCounter) count(metachan chan<- map[string]interface{}, f func(s *runStats)) {
+	f(c.stats)
+
+	c.Lock()
+	c.counted++
+	done := c.done()
+	c.Unlock()
+
+	if done {
+		c.send(metachan)
+	}
+}
+
+// end notes that the input has n records and sends the statistics on
+// metachan if they have all been counted.
+func (c *runCounter) end(n int, metachan chan<- map[string]interface{}) {
+	c.Lock()
+	c.total = n
+	done := c.done()
+	c.Unlock()
+
+	if done {
+		c.send(metachan)
+	}
+}
+
+// done returns true once all records have been counted, and only once, so
+// that the statistics are sent only once. Call it with c locked.
+func (c *runCounter) done() bool {
+	if c.counted != c.total {
+		return false
+	}
+	c.total = -1
+	return true
+}
+
+func (c *runCounter) send(metachan chan<- map[string]interface{}) {
+	md := make(map[string]interface{})
+	c.stats.addTo(md)
+	metachan <- md
+}
+
+// mergeRunStats merges metadata sent by the normalization functions into the output metadata.
+// Counts and maps of counts are added up; anything else is overwritten.
+func mergeRunStats(in map[string]interface{}, accumulator map[string]interface{}) {
+	for k, v := range in {
+		switch v := v.(type) {
+		case int:
+			n, _ := accumulator[k].(int)
+			accumulator[k] = n + v
+		case map[string]int:
+			m, ok := accumulator[k].(map[string]int)
+			if !ok {
+				m = make(map[string]int)
+				accumulator[k] = m
+			}
+			for kk, vv := range v {
+				m[kk] += vv
+			}
+		default:
+			accumulator[k] = v
+		}
+	}
+
+	accumulator["elapsed"] = time.Since(runStart).String()
+}
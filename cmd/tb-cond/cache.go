@@ -0,0 +1,159 @@
+// Copyright 2018 Zurich University of Applied Sciences.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheVersion is the version of the cache entries we write. Change it
+// whenever what we count or how we store it changes, so that old entries
+// are no longer used.
+const cacheVersion = 2
+
+// cacheEntry is the cached result of counting the names in one file. It
+// is valid as long as the file has the same size and modification time
+// and we count the same things.
+type cacheEntry struct {
+	Version int       `json:"version"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Options string    `json:"options"`
+	Stats   *stats    `json:"stats"`
+}
+
+// fileCache keeps the counts of each file in a directory, so that a
+// later run only has to count the files that are new or have changed. A
+// nil cache caches nothing.
+type fileCache struct {
+	dir     string
+	rebuild bool // ignore existing entries, but write new ones
+}
+
+var cache *fileCache
+
+// cacheOptions describes the options that change what we count. Entries
+// written with other options are not used.
+func cacheOptions() string {
+	return fmt.Sprintf("values=%s top=%d positions=%t group-by=%s validate=%t", *values, *topN, *positions, *groupBy, *validate)
+}
+
+// entryPath returns the path of the cache entry for the file at path.
+func (c *fileCache) entryPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// load returns the cached counts of the file at path, or nil if there
+// are none or they are out of date.
+func (c *fileCache) load(path string, fi os.FileInfo) *stats {
+	if c == nil || c.rebuild {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(c.entryPath(path))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("ERROR: can't read cache entry for \"%s\": %v", path, err)
+		}
+		return nil
+	}
+
+	var e cacheEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		log.Printf("ERROR: can't parse cache entry for \"%s\": %v", path, err)
+		return nil
+	}
+
+	if e.Version != cacheVersion || e.Size != fi.Size() || !e.ModTime.Equal(fi.ModTime()) ||
+		e.Options != cacheOptions() || e.Stats == nil {
+		return nil
+	}
+
+	e.Stats.FilesCached = 1
+	return e.Stats
+}
+
+// store writes the counts of the file at path to the cache. The entry is
+// written to a temporary file first, so that an interrupted run doesn't
+// leave a truncated entry behind.
+func (c *fileCache) store(path string, fi os.FileInfo, stat *stats) {
+	if c == nil {
+		return
+	}
+
+	b, err := json.Marshal(cacheEntry{
+		Version: cacheVersion,
+		Path:    path,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		Options: cacheOptions(),
+		Stats:   stat,
+	})
+	if err != nil {
+		log.Printf("ERROR: can't encode cache entry for \"%s\": %v", path, err)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, "entry-")
+	if err != nil {
+		log.Printf("ERROR: can't create cache entry for \"%s\": %v", path, err)
+		return
+	}
+
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.entryPath(path))
+	}
+	if err != nil {
+		log.Printf("ERROR: can't write cache entry for \"%s\": %v", path, err)
+		os.Remove(tmp.Name())
+	}
+}
+
+// ssJSON is how a spaceSaving sketch is stored in the cache.
+type ssJSON struct {
+	K        int         `json:"k"`
+	Counters []ssCounter `json:"counters"`
+}
+
+func (s *spaceSaving) MarshalJSON() ([]byte, error) {
+	cs := make([]ssCounter, len(s.heap))
+	for i, c := range s.heap {
+		cs[i] = *c
+	}
+	return json.Marshal(ssJSON{K: s.k, Counters: cs})
+}
+
+func (s *spaceSaving) UnmarshalJSON(b []byte) error {
+	var sj ssJSON
+	if err := json.Unmarshal(b, &sj); err != nil {
+		return err
+	}
+
+	*s = *newSpaceSaving(sj.K)
+	for i := range sj.Counters {
+		c := &sj.Counters[i]
+		s.counters[c.Value] = c
+		heap.Push(&s.heap, c)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	const records = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "m":[{"n":"TCP::O::MSS", "v":"0564"}], "a":[], "d":[]}]}
+`
+
+	dir, err := ioutil.TempDir("", "tb-cond")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(records))
+	w.Close()
+
+	path := filepath.Join(dir, "80-1-128.112.139.1.json.gz")
+	if err := ioutil.WriteFile(path, gz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	*values = "TCP::O::MSS"
+	valueNames = parseValueSelection(*values)
+	cache = &fileCache{dir: filepath.Join(dir, "cache")}
+	defer func() {
+		*values = ""
+		valueNames = nil
+		cache = nil
+	}()
+	if err := os.Mkdir(cache.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	process := func() *stats {
+		s, err := processFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	if s := process(); s.FilesCached != 0 || s.Conditions["TCP::O::MSS"].Count != 1 {
+		t.Fatalf("bad counts on first run %+v", s)
+	}
+
+	s := process()
+	if s.FilesCached != 1 || s.Conditions["TCP::O::MSS"].Count != 1 {
+		t.Fatalf("bad counts from cache %+v", s)
+	}
+	if top := s.Values["TCP::O::MSS"].top(1); len(top) != 1 || top[0].Value != "0564" || top[0].Count != 1 {
+		t.Errorf("bad values from cache %+v", top)
+	}
+
+	// A changed file is counted again.
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if s := process(); s.FilesCached != 0 {
+		t.Errorf("changed file counted from cache")
+	}
+
+	// So is one counted with other options.
+	*positions = true
+	defer func() { *positions = false }()
+	if s := process(); s.FilesCached != 0 {
+		t.Errorf("file counted from cache with other options")
+	}
+
+	cache.rebuild = true
+	if s := process(); s.FilesCached != 0 {
+		t.Errorf("file counted from cache while rebuilding")
+	}
+}
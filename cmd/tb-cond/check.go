@@ -0,0 +1,104 @@
+// Copyright 2018 Zurich University of Applied Sciences.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Why a name fails the check.
+const (
+	checkMissing   = "missing"   // not in the decision table at all
+	checkUndecided = "undecided" // in the table, but without a decision
+)
+
+// uncheckedName is a name that the normalizer doesn't know what to do with.
+type uncheckedName struct {
+	Name   string `json:"name"`
+	Count  uint64 `json:"count"`
+	Status string `json:"status"`
+}
+
+// checkNames returns the names in s that the decision table compiled into
+// tb-cond from pto3-trace.go has no decision for, most frequent first. Each
+// name is checked against the table for each way it was seen: modifications
+// against tbToCond, additions against tbAddToCond, and deletions against
+// tbDelToCond. Ignored names pass for all three.
+func checkNames(s *stats) []uncheckedName {
+	ignored := stringSet(tbIgnored)
+	changed := make(map[string]bool, len(tbToCond))
+	for k := range tbToCond {
+		changed[k] = true
+	}
+	added := stringSet(tbAdded)
+	stripped := stringSet(tbStripped)
+	undecided := stringSet(tbUndecided)
+
+	var ret []uncheckedName
+	for _, c := range sortedCounts(s) {
+		switch {
+		case ignored[c.Name]:
+		case (c.Modified == 0 || changed[c.Name]) &&
+			(c.Added == 0 || added[c.Name]) &&
+			(c.Removed == 0 || stripped[c.Name]):
+		case undecided[c.Name]:
+			ret = append(ret, uncheckedName{c.Name, c.Count, checkUndecided})
+		default:
+			ret = append(ret, uncheckedName{c.Name, c.Count, checkMissing})
+		}
+	}
+
+	return ret
+}
+
+// stringSet returns the strings in s as a set.
+func stringSet(s []string) map[string]bool {
+	ret := make(map[string]bool, len(s))
+	for _, v := range s {
+		ret[v] = true
+	}
+	return ret
+}
+
+// writeCheck writes the names that failed the check to out in the given
+// format.
+func writeCheck(out io.Writer, unchecked []uncheckedName, format string) error {
+	switch format {
+	case formatTable:
+		for _, u := range unchecked {
+			if _, err := fmt.Fprintf(out, "%12d %-40s %s\n", u.Count, u.Name, u.Status); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case formatJSON:
+		if unchecked == nil {
+			unchecked = []uncheckedName{}
+		}
+		b, err := json.MarshalIndent(unchecked, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", b)
+		return err
+
+	case formatCSV:
+		w := csv.NewWriter(out)
+		w.Write([]string{"name", "count", "status"})
+		for _, u := range unchecked {
+			w.Write([]string{u.Name, strconv.FormatUint(u.Count, 10), u.Status})
+		}
+		w.Flush()
+		return w.Error()
+
+	default:
+		return fmt.Errorf("unknown format %s", format)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCheckNames(t *testing.T) {
+	s := newStats()
+	s.Conditions["IP::TTL"] = &tbStat{Count: 10, Modified: 10}
+	s.Conditions["TCP::O::MSS"] = &tbStat{Count: 5, Modified: 5}
+	s.Conditions["TCP::O::TCPFastOpen"] = &tbStat{Count: 3, Added: 3}
+
+	unchecked := checkNames(s)
+	if len(unchecked) != 1 {
+		t.Fatalf("want 1 unchecked name, got %+v", unchecked)
+	}
+	if u := unchecked[0]; u.Name != "TCP::O::TCPFastOpen" || u.Count != 3 || u.Status != checkMissing {
+		t.Errorf("bad unchecked name %+v", u)
+	}
+
+	var b bytes.Buffer
+	if err := writeCheck(&b, unchecked, formatTable); err != nil {
+		t.Fatal(err)
+	}
+	if want := "           3 TCP::O::TCPFastOpen                      missing\n"; b.String() != want {
+		t.Errorf("want %q, got %q", want, b.String())
+	}
+}
+
+func TestCheckKinds(t *testing.T) {
+	s := newStats()
+	s.Conditions["TCP::O::SACKPermitted"] = &tbStat{Count: 4, Added: 2, Removed: 2}
+	s.Conditions["IP::DiffServicesCP"] = &tbStat{Count: 2, Modified: 1, Added: 1}
+
+	unchecked := checkNames(s)
+	if len(unchecked) != 1 {
+		t.Fatalf("want 1 unchecked name, got %+v", unchecked)
+	}
+	if u := unchecked[0]; u.Name != "IP::DiffServicesCP" || u.Status != checkMissing {
+		t.Errorf("bad unchecked name %+v", u)
+	}
+}
+
+func TestCheckUndecided(t *testing.T) {
+	if len(tbUndecided) == 0 {
+		t.Skip("no undecided names in the decision table")
+	}
+
+	s := newStats()
+	s.Conditions[tbUndecided[0]] = &tbStat{Count: 1, Modified: 1}
+
+	unchecked := checkNames(s)
+	if len(unchecked) != 1 || unchecked[0].Status != checkUndecided {
+		t.Errorf("want %s undecided, got %+v", tbUndecided[0], unchecked)
+	}
+}
@@ -8,43 +8,146 @@ Tb-cond goes through tracebox files looking for candidates for PTO conditions.
 
 Tracebox files contain lines that note changes, additions from, and deletions
 to IP and TCP headers. What exactly changed is captured in name-value pairs
-where the names look like IP:TTL or TCP::SeqNumber. This program looks
-through all the files on the command line and collects, counts, and sorts those
-names. An example output might be:
-
-     5412080 IP::TTL
-     5412080 IP::Checksum
-     2845976 IP::DiffServicesCP
-       35282 TCP::O::MSS
-        7806 TCP::Checksum
-         796 TCP::O::SACKPermitted
-         302 IP::Length
-         250 IP::ID
-         235 TCP::SeqNumber
-          81 TCP::O::WSOPT-WindowScale
-          72 TCP::Window
-          50 TCP::Offset
-          42 TCP::O::TSOPT-TimeStampOption
-          13 TCP::Flags
-          10 IP::ECN
-           6 TCP::UrgentPtr
-           6 TCP::Reserved
-           3 TCP::O::Echo
-           3 TCP::O::Quick-StartResponse
-           2 TCP::O::PartialOrderConnectionPermitted
-           2 TCP::O::TCPAuthenticationOption
-           2 TCP::O::PartialOrderServiceProfile
-           1 TCP::O::CC.ECHO
-           1 TCP::O::SelectiveNegativeAck
-           1 TCP::O::EchoReply
+where the names look like IP:TTL or TCP::SeqNumber. This program parses
+the records in all the files on the command line and counts those names,
+both in total and separately for modifications, additions, and deletions,
+and sorts them. An example output might be:
+
+	     5412080 IP::TTL                         |
+	     5412080 IP::Checksum                    |
+	     2845976 IP::DiffServicesCP              |
+	       35282 TCP::O::MSS                     |
+	        7806 TCP::Checksum                   |
+	         796 TCP::O::SACKPermitted           |
+	         302 IP::Length                      |
+	         ...
+
+Lines that are not records, such as empty lines, are skipped. Records
+that cannot be parsed or have hops that are null or have invalid TTLs are
+counted as bad records. With -validate, so are records that fail the
+other checks of the tracebox package, such as TTLs that don't increase.
 
 In order to speed up operations, this program uses workers that look through files
-in parallel.
+in parallel. Files that can't be read are logged and counted as failed, in
+JSON as "files_failed". On SIGINT, tb-cond stops handing out files, writes
+the counts of the files processed so far, marked as "interrupted" in JSON,
+and exits with status 130; a second SIGINT stops it at once.
+
+Uncompressed files are mapped into memory. Files compressed with gzip, bzip2,
+xz, or zstd, which is recognized by their first few bytes, not their names,
+are decompressed and read line by line instead.
+
+The output above is the default table format. Its rows are in the format
+of the decision table in pto3-trace.go, so that new names can be pasted
+into it. With -kinds, the table has a header and the counts per kind of
+change instead, and can no longer be pasted:
+
+	       Count Name                                         Modified        Added      Removed
+	       35282 TCP::O::MSS                                     35193           57           32
+	         796 TCP::O::SACKPermitted                               0            0          796
+	         ...
+
+With -format=json,
+tb-cond writes the counts together with the number of files, bytes, and
+records processed and the elapsed time, for example
+
+	{
+	  "files_processed": 2,
+	  "files_total": 2,
+	  "files_failed": 0,
+	  "interrupted": false,
+	  "bytes_processed": 1234,
+	  "records": 10,
+	  "bad_records": 0,
+	  "elapsed": "2s",
+	  "conditions": [
+	    {"name": "IP::TTL", "count": 5412080, "modified": 5412080, "added": 0, "removed": 0},
+	    ...
+	  ]
+	}
+
+which pto3-trace-gencond -counts reads to find names that are missing from
+the decision table. With -format=csv, it writes a header and a row for each
+name with the same columns as the table with -kinds. For both, progress goes to
+stderr, as it does with -check.
+
+With -values, tb-cond also finds the most frequent values to which the
+selected names were changed or with which they were added, such as MSS
+0x0564 (1380) versus 0x05b4 (1460). Select names with a comma-separated
+list, as in -values=TCP::O::MSS,IP::DiffServicesCP, or all names with
+-values=all. The -top most frequent values of each name are reported
+after the row of their name in the table, in a "values" array in JSON,
+and in a last column in CSV.
+
+Counting every distinct value would take memory in proportion to the
+number of distinct values, which for fields like IP::ID is most of them.
+Instead, tb-cond uses a Space-Saving sketch with ten counters for every
+value reported, so memory is bounded no matter how big the campaign is.
+With -top n, a value that makes up more than 1/(10n) of the changes of
+its name is guaranteed to be found. Its count may be too high by at most
+the "error" reported in JSON.
+
+With -positions, tb-cond also reports, for each name, where on the path
+a change is first observed in a trace: at the first hop, in the middle,
+at the last hop before the destination, or only at the destination; and
+the distribution of the TTLs at which it is first observed. MSS clamping
+that is first observed at the first hop happens in the access network;
+clamping first observed at the last hop happens near the server. The
+positions follow the row of their name in the table, are in a
+"positions" object in JSON, and are in further columns in CSV.
+
+With -group-by, tb-cond counts each name per group and writes a matrix
+with a row for each name and a column for each group instead of the
+counts above, so that a single vantage point whose access network is
+responsible for most of a condition stands out:
+
+	Name                                     128.112.139.1   130.59.31.80
+	TCP::O::MSS                                      35120            162
+	...
+
+Group by vantage or port to use the source address or the destination
+port in file names of the form <port>-<num>-<src_ip>.json, as
+pto3-trace-mkmeta does; files with other names are in the group
+"unknown". Group by dst-prefix to use the /24 or /48 of each record's
+destination, or by file to use the file. In JSON, the matrix has the
+groups and, for each name, its nonzero counts by group; in CSV, it has a
+header with the groups and a row for each name.
+
+With -cache dir, tb-cond keeps the counts of each file in dir and, on
+later runs, reuses them for files whose size and modification time
+haven't changed, so that adding a few files to a campaign doesn't mean
+counting all of it again. Counts are only reused if they were made with
+the same -values, -top, -positions, and -group-by. With -rebuild-cache,
+tb-cond counts all files again and replaces what is in the cache. To
+remove the cache, remove dir.
+
+With -check, tb-cond doesn't write the counts. Instead, it checks the
+names it found against the decision table in pto3-trace.go, as compiled
+into tb-cond by go generate, and writes the names that are neither mapped
+to a condition nor ignored, with their counts and whether they are
+missing from the table or in it but undecided. Names that tracebox
+reports as added or deleted are checked against the maps for additions
+and deletions in pto3-trace.go instead:
+
+	           3 TCP::O::TCPFastOpen                      missing
+
+It exits with status 1 if there are any, so that it can gate the
+ingestion of a new campaign. After changing the decision table, run go
+generate and rebuild tb-cond.
 
 Usage:
 
-	tb-cond [-workers n] file...
+	tb-cond [-workers n] [-format f] [-values names] [-top n] [-kinds] [-positions] [-group-by g] [-cache dir [-rebuild-cache]] [-check] file...
 
 	-workers n	use n workers (default 1)
+	-format f	write table, json, or csv (default table)
+	-values names	collect values of names, comma-separated, or all
+	-top n		report the n most frequent values per name (default 10)
+	-kinds		count modifications, additions, and deletions in the table
+	-positions	report where on the path changes are first observed
+	-group-by g	count per vantage, port, dst-prefix, or file
+	-cache dir	keep the counts of each file in dir and reuse them
+	-rebuild-cache	count all files again and replace their cached counts
+	-check		report names without a decision and exit 1 if there are any
 */
 package main
@@ -0,0 +1,199 @@
+// Copyright 2018 Zurich University of Applied Sciences.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/mami-project/pto3-trace/tracebox"
+)
+
+// What to group counts by with -group-by.
+const (
+	groupVantage   = "vantage"    // the source address in the file name
+	groupPort      = "port"       // the destination port in the file name
+	groupDstPrefix = "dst-prefix" // the /24 or /48 of the destination
+	groupFile      = "file"       // the file
+)
+
+// groupUnknown is the group of records whose group can't be determined,
+// such as those in files whose names don't have the expected form.
+const groupUnknown = "unknown"
+
+func validGroupBy(groupBy string) bool {
+	switch groupBy {
+	case "", groupVantage, groupPort, groupDstPrefix, groupFile:
+		return true
+	default:
+		return false
+	}
+}
+
+// fileGroup returns the group of all records in the file at path, or the
+// empty string if records aren't grouped by file or each record has its
+// own group.
+func fileGroup(path string, groupBy string) string {
+	switch groupBy {
+	case groupVantage, groupPort:
+		fn, err := tracebox.ParseFileName(path)
+		if err != nil {
+			return groupUnknown
+		}
+		if groupBy == groupVantage {
+			return fn.Source.String()
+		}
+		return strconv.Itoa(fn.Port)
+	case groupFile:
+		return path
+	default:
+		return ""
+	}
+}
+
+// dstPrefix returns the /24 of an IPv4 destination or the /48 of an IPv6
+// destination, which is roughly what a single network announces.
+func dstPrefix(dst string) string {
+	ip := net.ParseIP(dst)
+	if ip == nil {
+		return groupUnknown
+	}
+
+	var n *net.IPNet
+	if ip4 := ip.To4(); ip4 != nil {
+		n = &net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+	} else {
+		n = &net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}
+	}
+	return n.String()
+}
+
+// recordGroup returns the group of t in a file whose group is group.
+func recordGroup(t *tracebox.Trace, group string) string {
+	if *groupBy == groupDstPrefix {
+		return dstPrefix(t.Dst)
+	}
+	return group
+}
+
+// addGroup counts an instance of name in group, if we're grouping.
+func (s *stats) addGroup(group string, name string) {
+	if group == "" {
+		return
+	}
+
+	g := s.Groups[group]
+	if g == nil {
+		g = make(map[string]uint64)
+		s.Groups[group] = g
+	}
+	g[name]++
+}
+
+// sortedGroups returns the groups in s in order.
+func sortedGroups(s *stats) []string {
+	ret := make([]string, 0, len(s.Groups))
+	for k := range s.Groups {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// groupCounts is how often a name was seen in each group.
+type groupCounts struct {
+	Name   string            `json:"name"`
+	Counts map[string]uint64 `json:"counts"`
+}
+
+// matrix is what we output in JSON with -group-by.
+type matrix struct {
+	GroupBy    string        `json:"group_by"`
+	Groups     []string      `json:"groups"`
+	Conditions []groupCounts `json:"conditions"`
+}
+
+// writeMatrix writes the counts of each name per group in s to out in the
+// given format, with a row for each name, most frequent first, and a
+// column for each group.
+func writeMatrix(out io.Writer, s *stats, format string) error {
+	groups := sortedGroups(s)
+	counts := sortedCounts(s)
+
+	switch format {
+	case formatTable:
+		widths := make([]int, len(groups))
+		if _, err := fmt.Fprintf(out, "%-40s", "Name"); err != nil {
+			return err
+		}
+		for i, g := range groups {
+			widths[i] = 12
+			if len(g) > widths[i] {
+				widths[i] = len(g)
+			}
+			if _, err := fmt.Fprintf(out, " %*s", widths[i], g); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(out); err != nil {
+			return err
+		}
+
+		for _, c := range counts {
+			if _, err := fmt.Fprintf(out, "%-40s", c.Name); err != nil {
+				return err
+			}
+			for i, g := range groups {
+				if _, err := fmt.Fprintf(out, " %*d", widths[i], s.Groups[g][c.Name]); err != nil {
+					return err
+				}
+			}
+			if _, err := fmt.Fprintln(out); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case formatJSON:
+		m := matrix{GroupBy: *groupBy, Groups: groups, Conditions: make([]groupCounts, len(counts))}
+		for i, c := range counts {
+			gc := groupCounts{Name: c.Name, Counts: make(map[string]uint64)}
+			for _, g := range groups {
+				if n := s.Groups[g][c.Name]; n > 0 {
+					gc.Counts[g] = n
+				}
+			}
+			m.Conditions[i] = gc
+		}
+
+		b, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", b)
+		return err
+
+	case formatCSV:
+		w := csv.NewWriter(out)
+		w.Write(append([]string{"name"}, groups...))
+		for _, c := range counts {
+			row := []string{c.Name}
+			for _, g := range groups {
+				row = append(row, strconv.FormatUint(s.Groups[g][c.Name], 10))
+			}
+			w.Write(row)
+		}
+		w.Flush()
+		return w.Error()
+
+	default:
+		return fmt.Errorf("unknown format %s", format)
+	}
+}
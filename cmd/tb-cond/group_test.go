@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGroups(t *testing.T) {
+	if g := fileGroup("/data/80-1-128.112.139.1.json.gz", groupVantage); g != "128.112.139.1" {
+		t.Errorf("bad vantage group %s", g)
+	}
+	if g := fileGroup("/data/80-1-128.112.139.1.json.gz", groupPort); g != "80" {
+		t.Errorf("bad port group %s", g)
+	}
+	if g := fileGroup("/data/trace.json", groupVantage); g != groupUnknown {
+		t.Errorf("bad vantage group for unknown file %s", g)
+	}
+
+	if p := dstPrefix("88.212.202.2"); p != "88.212.202.0/24" {
+		t.Errorf("bad IPv4 prefix %s", p)
+	}
+	if p := dstPrefix("2001:db8:1:2::1"); p != "2001:db8:1::/48" {
+		t.Errorf("bad IPv6 prefix %s", p)
+	}
+}
+
+func TestWriteMatrix(t *testing.T) {
+	const records = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "m":[{"n":"TCP::O::MSS", "v":"0564"}], "a":[], "d":[{"n":"TCP::O::SACKPermitted", "v":""}]}]}
+{"dst":"130.59.31.80", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "m":[{"n":"TCP::O::MSS", "v":"0564"}], "a":[], "d":[]}]}
+`
+
+	*groupBy = groupDstPrefix
+	defer func() { *groupBy = "" }()
+
+	s := newStats()
+	countRecords([]byte(records), s)
+
+	other := newStats()
+	other.merge(s)
+
+	var out bytes.Buffer
+	if err := writeMatrix(&out, other, formatCSV); err != nil {
+		t.Fatal(err)
+	}
+
+	const expected = `name,130.59.31.0/24,88.212.202.0/24
+TCP::O::MSS,1,1
+TCP::O::SACKPermitted,0,1
+`
+	if out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2018 Zurich University of Applied Sciences.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Output formats.
+const (
+	formatTable = "table" // for pasting into the table in pto3-trace.go
+	formatJSON  = "json"
+	formatCSV   = "csv"
+)
+
+func validFormat(format string) bool {
+	return format == formatTable || format == formatJSON || format == formatCSV
+}
+
+// conditionCount is how often a name was seen, in total and per kind of
+// change.
+type conditionCount struct {
+	Name     string `json:"name"`
+	Count    uint64 `json:"count"`
+	Modified uint64 `json:"modified"`
+	Added    uint64 `json:"added"`
+	Removed  uint64 `json:"removed"`
+
+	// The most frequent new values, if collected. The true count of a
+	// value is between Count-Error and Count.
+	Values []valueCount `json:"values,omitempty"`
+
+	// Where changes are first observed, if collected.
+	Positions *positionStat `json:"positions,omitempty"`
+}
+
+// valueCount is how often a name was changed to or added with a value.
+type valueCount struct {
+	Value string `json:"value"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+// formatValue adds the "0x" that tracebox leaves off its hex values.
+func formatValue(v string) string {
+	if v == "" {
+		return v
+	}
+	return "0x" + v
+}
+
+// ttlString formats a TTL distribution as "ttl:count" pairs in TTL order.
+func ttlString(ttls map[int]uint64) string {
+	keys := make([]int, 0, len(ttls))
+	for k := range ttls {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	vs := make([]string, len(keys))
+	for i, k := range keys {
+		vs[i] = fmt.Sprintf("%d:%d", k, ttls[k])
+	}
+	return strings.Join(vs, " ")
+}
+
+// topValues returns the n most frequent values in vs.
+func topValues(vs *spaceSaving, n int) []valueCount {
+	if vs == nil {
+		return nil
+	}
+
+	var ret []valueCount
+	for _, c := range vs.top(n) {
+		ret = append(ret, valueCount{Value: formatValue(c.Value), Count: c.Count, Error: c.Err})
+	}
+	return ret
+}
+
+// report is what we output in JSON.
+type report struct {
+	FilesProcessed uint             `json:"files_processed"`
+	FilesTotal     uint             `json:"files_total"`
+	FilesFailed    uint             `json:"files_failed"`
+	Interrupted    bool             `json:"interrupted"`
+	BytesProcessed uint64           `json:"bytes_processed"`
+	Records        uint64           `json:"records"`
+	BadRecords     uint64           `json:"bad_records"`
+	Elapsed        string           `json:"elapsed"`
+	Conditions     []conditionCount `json:"conditions"`
+}
+
+// sortedCounts returns the counts with the most frequent name first. Names
+// with the same count are sorted by name, so that the output is stable.
+func sortedCounts(s *stats) []conditionCount {
+	ret := make([]conditionCount, 0, len(s.Conditions))
+	for k, v := range s.Conditions {
+		ret = append(ret, conditionCount{
+			Name:      k,
+			Count:     v.Count,
+			Modified:  v.Modified,
+			Added:     v.Added,
+			Removed:   v.Removed,
+			Values:    topValues(s.Values[k], *topN),
+			Positions: s.Positions[k],
+		})
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Name < ret[j].Name
+	})
+
+	return ret
+}
+
+// writeStats writes s to out in the given format. The table has only the
+// counts, and its rows are in the format of the decision table in
+// pto3-trace.go, so that they can be pasted into it. With -kinds, it has a
+// header and the counts per kind of change instead, and can't be pasted.
+// Collected values and positions follow the row of their name. CSV has a
+// header and a row for each name, with the values in a last column if
+// they were collected.
+func writeStats(out io.Writer, s *stats, format string) error {
+	counts := sortedCounts(s)
+
+	switch format {
+	case formatTable:
+		if *kinds {
+			if _, err := fmt.Fprintf(out, "%12s %-40s %12s %12s %12s\n",
+				"Count", "Name", "Modified", "Added", "Removed"); err != nil {
+				return err
+			}
+		}
+		for _, c := range counts {
+			var err error
+			if *kinds {
+				_, err = fmt.Fprintf(out, "%12d %-40s %12d %12d %12d\n",
+					c.Count, c.Name, c.Modified, c.Added, c.Removed)
+			} else {
+				_, err = fmt.Fprintf(out, "%12d %-31s |\n", c.Count, c.Name)
+			}
+			if err != nil {
+				return err
+			}
+			for _, v := range c.Values {
+				if _, err := fmt.Fprintf(out, "%12s   %-38s %12d\n", "", v.Value, v.Count); err != nil {
+					return err
+				}
+			}
+			if p := c.Positions; p != nil {
+				if _, err := fmt.Fprintf(out, "%12s   first %d, middle %d, last %d, destination %d; by TTL %s\n",
+					"", p.First, p.Middle, p.Last, p.Destination, ttlString(p.TTL)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+
+	case formatJSON:
+		b, err := json.MarshalIndent(report{
+			FilesProcessed: s.FilesProcessed,
+			FilesTotal:     s.FilesTotal,
+			FilesFailed:    s.FilesFailed,
+			Interrupted:    s.Interrupted,
+			BytesProcessed: s.BytesProcessed,
+			Records:        s.Records,
+			BadRecords:     s.BadRecords,
+			Elapsed:        s.TimeElapsed.String(),
+			Conditions:     counts,
+		}, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", b)
+		return err
+
+	case formatCSV:
+		w := csv.NewWriter(out)
+		withValues := len(s.Values) > 0
+		withPositions := len(s.Positions) > 0
+
+		header := []string{"name", "count", "modified", "added", "removed"}
+		if withValues {
+			header = append(header, "values")
+		}
+		if withPositions {
+			header = append(header, "first", "middle", "last", "destination", "ttl")
+		}
+		w.Write(header)
+
+		for _, c := range counts {
+			row := []string{c.Name,
+				strconv.FormatUint(c.Count, 10),
+				strconv.FormatUint(c.Modified, 10),
+				strconv.FormatUint(c.Added, 10),
+				strconv.FormatUint(c.Removed, 10),
+			}
+			if withValues {
+				vs := make([]string, len(c.Values))
+				for i, v := range c.Values {
+					vs[i] = v.Value + "=" + strconv.FormatUint(v.Count, 10)
+				}
+				row = append(row, strings.Join(vs, " "))
+			}
+			if withPositions {
+				p := c.Positions
+				if p == nil {
+					p = newPositionStat()
+				}
+				row = append(row,
+					strconv.FormatUint(p.First, 10),
+					strconv.FormatUint(p.Middle, 10),
+					strconv.FormatUint(p.Last, 10),
+					strconv.FormatUint(p.Destination, 10),
+					ttlString(p.TTL))
+			}
+			w.Write(row)
+		}
+		w.Flush()
+		return w.Error()
+
+	default:
+		return fmt.Errorf("unknown format %s", format)
+	}
+}
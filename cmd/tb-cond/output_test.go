@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testStats() *stats {
+	s := newStats()
+	s.Conditions["IP::TTL"] = &tbStat{Count: 10, Modified: 10}
+	s.Conditions["TCP::O::MSS"] = &tbStat{Count: 3, Modified: 1, Added: 1, Removed: 1}
+	s.Conditions["IP::Checksum"] = &tbStat{Count: 10, Modified: 10}
+	s.FilesProcessed = 2
+	s.FilesTotal = 2
+	s.BytesProcessed = 1234
+	s.TimeElapsed = 2 * time.Second
+	return s
+}
+
+func TestWriteTable(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeStats(&b, testStats(), formatTable); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rows must paste into the decision table in pto3-trace.go, as
+	// pto3-trace-gencond reads it.
+	rowRe := regexp.MustCompile(`^\s*(\d+) (\S+)\s+\|(.*)$`)
+
+	lines := strings.Split(b.String(), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("want 3 rows and a newline, got %q", b.String())
+	}
+	for _, l := range lines[:3] {
+		if !rowRe.MatchString(l) {
+			t.Errorf("row doesn't paste into the decision table: %q", l)
+		}
+	}
+	if lines[2] != "           3 TCP::O::MSS                     |" {
+		t.Errorf("bad row %q", lines[2])
+	}
+}
+
+func TestWriteTableKinds(t *testing.T) {
+	*kinds = true
+	defer func() { *kinds = false }()
+
+	var b bytes.Buffer
+	if err := writeStats(&b, testStats(), formatTable); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(b.String(), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("want header, 3 rows, and a newline, got %q", b.String())
+	}
+	if f := strings.Fields(lines[3]); len(f) != 5 || f[0] != "3" || f[1] != "TCP::O::MSS" || f[3] != "1" {
+		t.Errorf("bad row %q", lines[3])
+	}
+	if !strings.HasPrefix(lines[1], "          10 IP::Checksum ") {
+		t.Errorf("bad row %q", lines[1])
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeStats(&b, testStats(), formatJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	var r report
+	if err := json.Unmarshal(b.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.FilesProcessed != 2 || r.BytesProcessed != 1234 || r.Elapsed != "2s" {
+		t.Errorf("bad report %+v", r)
+	}
+	if len(r.Conditions) != 3 || r.Conditions[2].Name != "TCP::O::MSS" || r.Conditions[2].Count != 3 || r.Conditions[2].Removed != 1 {
+		t.Errorf("bad counts %+v", r.Conditions)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeStats(&b, testStats(), formatCSV); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || records[0][0] != "name" || records[3][0] != "TCP::O::MSS" || records[3][1] != "3" || records[3][4] != "1" {
+		t.Errorf("bad CSV %v", records)
+	}
+}
+
+func TestCountRecords(t *testing.T) {
+	const records = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "pt":"syn", "p":[{"n":"TCP::O::MSS", "v":"05b4"}], "h":[{"ha":"128.112.139.1", "t":1, "i":2, "m":[{"n":"TCP::O::MSS", "v":"0564"}], "a":[{"n":"TCP::O::MSS", "v":"0564"}], "d":[]}]}
+
+{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "i":2, "m":[], "a":[], "d":[{"n":"TCP::O::MSS", "v":"05b4"}, {"n":"TCP::O::SACKPermitted", "v":""}]}]}
+{"dst":"88.212.202.2", "h":[
+{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":2, "m":[], "a":[], "d":[]}, {"ha":"128.112.12.57", "t":1, "m":[], "a":[], "d":[]}]}
+{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[null]}
+`
+
+	s := newStats()
+	countRecords([]byte(records), s)
+
+	if s.Records != 3 || s.BadRecords != 2 {
+		t.Errorf("want 3 records and 2 bad records, got %d and %d", s.Records, s.BadRecords)
+	}
+
+	// The MSS in the probe isn't a change.
+	want := tbStat{Count: 3, Modified: 1, Added: 1, Removed: 1}
+	if got := s.Conditions["TCP::O::MSS"]; got == nil || *got != want {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+	if got := s.Conditions["TCP::O::SACKPermitted"]; got == nil || got.Removed != 1 {
+		t.Errorf("bad SACK permitted count %+v", got)
+	}
+
+	// TTLs that don't increase only make a bad record with -validate.
+	*validate = true
+	defer func() { *validate = false }()
+
+	s = newStats()
+	countRecords([]byte(records), s)
+
+	if s.Records != 2 || s.BadRecords != 3 {
+		t.Errorf("want 2 records and 3 bad records with -validate, got %d and %d", s.Records, s.BadRecords)
+	}
+}
+
+func TestCountValues(t *testing.T) {
+	const records = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "i":2, "m":[{"n":"TCP::O::MSS", "v":"0564"}, {"n":"IP::TTL", "v":"01"}], "a":[], "d":[]}, {"ha":"128.112.139.2", "t":2, "i":2, "m":[{"n":"TCP::O::MSS", "v":"0564"}], "a":[{"n":"TCP::O::MSS", "v":"05b4"}], "d":[]}]}
+`
+
+	valueNames = parseValueSelection("TCP::O::MSS")
+	defer func() { valueNames = nil }()
+
+	s := newStats()
+	countRecords([]byte(records), s)
+
+	if s.Values["IP::TTL"] != nil {
+		t.Errorf("collected values of a name that wasn't selected")
+	}
+
+	var b bytes.Buffer
+	if err := writeStats(&b, s, formatJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	var r report
+	if err := json.Unmarshal(b.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range r.Conditions {
+		if c.Name != "TCP::O::MSS" {
+			continue
+		}
+		if len(c.Values) != 2 || c.Values[0].Value != "0x0564" || c.Values[0].Count != 2 || c.Values[1].Value != "0x05b4" {
+			t.Errorf("bad values %+v", c.Values)
+		}
+	}
+}
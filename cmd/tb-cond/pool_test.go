@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+// memFiles is an in-memory set of tracebox files, by path.
+type memFiles map[string]string
+
+func (m memFiles) process(path string) (*stats, error) {
+	records, ok := m[path]
+	if !ok {
+		return nil, errors.New("no such file")
+	}
+
+	stat := newStats()
+	stat.BytesProcessed = uint64(len(records))
+	countRecords([]byte(records), stat)
+	return stat, nil
+}
+
+func (m memFiles) paths() []string {
+	var ret []string
+	for p := range m {
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+const mssRecord = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "m":[{"n":"TCP::O::MSS", "v":"0564"}], "a":[], "d":[]}]}
+`
+
+func withWorkers(n int) func() {
+	old := *nWorkers
+	oldProgress := progress
+	*nWorkers = n
+	progress = ioutil.Discard
+	return func() {
+		*nWorkers = old
+		progress = oldProgress
+	}
+}
+
+func TestProcessFiles(t *testing.T) {
+	defer withWorkers(4)()
+
+	files := memFiles{}
+	for _, p := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		files[p] = mssRecord
+	}
+
+	// A file that fails must not keep us waiting for it.
+	paths := append(files.paths(), "missing")
+
+	s := processFiles(context.Background(), paths, files.process)
+	if s.Interrupted {
+		t.Errorf("not interrupted, but marked as such")
+	}
+	if s.FilesProcessed != 9 || s.FilesTotal != 9 || s.FilesFailed != 1 {
+		t.Errorf("bad file counts %+v", s)
+	}
+	if c := s.Conditions["TCP::O::MSS"]; c == nil || c.Count != 8 {
+		t.Errorf("bad MSS count %+v", c)
+	}
+}
+
+func TestProcessFilesCancel(t *testing.T) {
+	defer withWorkers(2)()
+
+	files := memFiles{"a": mssRecord, "b": mssRecord, "c": mssRecord}
+
+	// Cancel once the first file has been processed. The others block
+	// until the test is over, and then fail without touching the flags
+	// that other tests change.
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	defer close(release)
+
+	first := make(chan struct{}, 1)
+	process := func(path string) (*stats, error) {
+		select {
+		case first <- struct{}{}:
+			s, err := files.process(path)
+			cancel()
+			return s, err
+		default:
+			<-release
+			return nil, errors.New("too late")
+		}
+	}
+
+	s := processFiles(ctx, files.paths(), process)
+	if !s.Interrupted {
+		t.Errorf("interrupted, but not marked as such")
+	}
+	if s.FilesProcessed > 1 || s.FilesTotal != 3 {
+		t.Errorf("bad file counts %+v", s)
+	}
+}
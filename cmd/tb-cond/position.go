@@ -0,0 +1,102 @@
+// Copyright 2018 Zurich University of Applied Sciences.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/mami-project/pto3-trace/tracebox"
+)
+
+// Where on the path a change is first observed.
+const (
+	posFirst       = "first"       // at the first hop, i.e., in the access network
+	posMiddle      = "middle"      // somewhere in between
+	posLast        = "last"        // at the last hop before the destination
+	posDestination = "destination" // only at the destination
+)
+
+// positionStat is the distribution of where on the path a change of a name
+// is first observed in a trace, by position and by TTL.
+type positionStat struct {
+	First       uint64         `json:"first"`
+	Middle      uint64         `json:"middle"`
+	Last        uint64         `json:"last"`
+	Destination uint64         `json:"destination"`
+	TTL         map[int]uint64 `json:"ttl"`
+}
+
+func newPositionStat() *positionStat {
+	return &positionStat{TTL: make(map[int]uint64)}
+}
+
+func (p *positionStat) count(position string, ttl int) {
+	switch position {
+	case posFirst:
+		p.First++
+	case posMiddle:
+		p.Middle++
+	case posLast:
+		p.Last++
+	case posDestination:
+		p.Destination++
+	}
+	p.TTL[ttl]++
+}
+
+// add adds the counts in o to p.
+func (p *positionStat) add(o *positionStat) {
+	p.First += o.First
+	p.Middle += o.Middle
+	p.Last += o.Last
+	p.Destination += o.Destination
+	for k, v := range o.TTL {
+		p.TTL[k] += v
+	}
+}
+
+// position returns where the hop with the given index is on the path of
+// t. Hops are numbered without the destination, which tracebox lists as
+// the last hop if it answered.
+func position(t *tracebox.Trace, index int) string {
+	n := len(t.Hops)
+	if n > 0 && tracebox.SameAddress(t.Hops[n-1].Address, t.Dst) {
+		if index == n-1 {
+			return posDestination
+		}
+		n--
+	}
+
+	switch index {
+	case 0:
+		return posFirst
+	case n - 1:
+		return posLast
+	default:
+		return posMiddle
+	}
+}
+
+// addPositions counts, for every name that changes in t, where the change
+// is first observed.
+func (s *stats) addPositions(t *tracebox.Trace) {
+	seen := make(map[string]bool)
+
+	for i, h := range t.Hops {
+		for _, nvs := range [][]tracebox.NameValue{h.Modifications, h.Additions, h.Deletions} {
+			for _, nv := range nvs {
+				if seen[nv.Name] {
+					continue
+				}
+				seen[nv.Name] = true
+
+				p := s.Positions[nv.Name]
+				if p == nil {
+					p = newPositionStat()
+					s.Positions[nv.Name] = p
+				}
+				p.count(position(t, i), h.TTL)
+			}
+		}
+	}
+}
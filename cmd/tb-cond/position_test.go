@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPositions(t *testing.T) {
+	// MSS changed at the first hop and again later, SACK permitted stripped
+	// at the last hop before the destination, window changed only at the
+	// destination.
+	const records = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "m":[{"n":"TCP::O::MSS", "v":"0564"}], "a":[], "d":[]}, {"ha":"128.112.12.57", "t":2, "m":[{"n":"TCP::O::MSS", "v":"0564"}], "a":[], "d":[]}, {"ha":"63.138.53.73", "t":4, "m":[], "a":[], "d":[{"n":"TCP::O::SACKPermitted", "v":""}]}, {"ha":"88.212.202.2", "t":5, "m":[{"n":"TCP::Window", "v":"2000"}], "a":[], "d":[]}]}
+{"dst":"88.212.202.2", "r":"timeout", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "m":[], "a":[], "d":[]}, {"ha":"128.112.12.57", "t":2, "m":[{"n":"TCP::O::MSS", "v":"0564"}], "a":[], "d":[]}, {"ha":"63.138.53.73", "t":3, "m":[], "a":[], "d":[]}]}
+`
+
+	*positions = true
+	defer func() { *positions = false }()
+
+	s := newStats()
+	countRecords([]byte(records), s)
+
+	mss := s.Positions["TCP::O::MSS"]
+	if mss == nil || mss.First != 1 || mss.Middle != 1 || mss.Last != 0 || mss.TTL[1] != 1 || mss.TTL[2] != 1 {
+		t.Errorf("bad MSS positions %+v", mss)
+	}
+
+	if sack := s.Positions["TCP::O::SACKPermitted"]; sack == nil || sack.Last != 1 || sack.TTL[4] != 1 {
+		t.Errorf("bad SACK permitted positions %+v", sack)
+	}
+
+	if win := s.Positions["TCP::Window"]; win == nil || win.Destination != 1 {
+		t.Errorf("bad window positions %+v", win)
+	}
+
+	other := newStats()
+	other.merge(s)
+	other.merge(s)
+	if mss := other.Positions["TCP::O::MSS"]; mss.First != 2 || mss.TTL[2] != 2 {
+		t.Errorf("bad merged MSS positions %+v", mss)
+	}
+}
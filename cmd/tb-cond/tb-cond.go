@@ -1,197 +1,473 @@
+//go:generate go run ../pto3-trace-gencond -o conditions.go ../pto3-trace/pto3-trace.go
+
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"os"
-	"regexp"
-	"sort"
+	"os/signal"
+	"strings"
+	"sync"
 	"time"
 
 	pto3 "github.com/mami-project/pto3-go"
+	trace "github.com/mami-project/pto3-trace"
+	"github.com/mami-project/pto3-trace/tracebox"
 )
 
+// tbStat counts how often a name was observed, in total and per kind of
+// change. Whether a change is middlebox fuckery may depend on the kind; a
+// middlebox adding an MSS option is different from one removing it.
 type tbStat struct {
-	Count uint64 // how many instances were observed
+	Count    uint64 // how many instances were observed
+	Modified uint64 // how many of them were modifications
+	Added    uint64 // how many of them were additions
+	Removed  uint64 // how many of them were deletions
+}
+
+// add adds the counts in o to s.
+func (s *tbStat) add(o *tbStat) {
+	s.Count += o.Count
+	s.Modified += o.Modified
+	s.Added += o.Added
+	s.Removed += o.Removed
 }
 
 type stats struct {
 	Conditions     map[string]*tbStat
 	FilesProcessed uint
 	FilesTotal     uint
+	FilesCached    uint // files whose counts came from the cache
+	FilesFailed    uint // files that couldn't be processed
+	Interrupted    bool // whether processing stopped before all files were processed
 	TimeElapsed    time.Duration
 	BytesProcessed uint64
+	Records        uint64 // records parsed
+	BadRecords     uint64 // records that couldn't be parsed or checked
+
+	// The most frequent new values of the names selected with -values.
+	Values map[string]*spaceSaving
+
+	// Where changes are first observed, with -positions.
+	Positions map[string]*positionStat
+
+	// How often each name was observed per group, with -group-by.
+	Groups map[string]map[string]uint64
+
+	// The group of the file being counted, if it has one.
+	group string
 }
 
 func newStats() *stats {
 	return &stats{
 		Conditions: make(map[string]*tbStat),
+		Values:     make(map[string]*spaceSaving),
+		Positions:  make(map[string]*positionStat),
+		Groups:     make(map[string]map[string]uint64),
+	}
+}
+
+// addValue counts a new value of name if we're collecting values for it.
+func (s *stats) addValue(name string, value string) {
+	if !valueNames.selected(name) {
+		return
+	}
+
+	vs := s.Values[name]
+	if vs == nil {
+		vs = newSpaceSaving(sketchFactor * *topN)
+		s.Values[name] = vs
+	}
+	vs.add(value, 1)
+}
+
+// condition returns the counts for name, creating them if necessary.
+func (s *stats) condition(name string) *tbStat {
+	c := s.Conditions[name]
+	if c == nil {
+		c = new(tbStat)
+		s.Conditions[name] = c
+	}
+	return c
+}
+
+// merge adds the counts in o to s.
+func (s *stats) merge(o *stats) {
+	for k, v := range o.Conditions {
+		s.condition(k).add(v)
+	}
+	s.FilesProcessed++
+	s.FilesCached += o.FilesCached
+	s.BytesProcessed += o.BytesProcessed
+	s.Records += o.Records
+	s.BadRecords += o.BadRecords
+
+	for k, v := range o.Values {
+		if s.Values[k] == nil {
+			s.Values[k] = newSpaceSaving(v.k)
+		}
+		s.Values[k].merge(v)
+	}
+
+	for k, v := range o.Positions {
+		if s.Positions[k] == nil {
+			s.Positions[k] = newPositionStat()
+		}
+		s.Positions[k].add(v)
+	}
+
+	for g, names := range o.Groups {
+		if s.Groups[g] == nil {
+			s.Groups[g] = make(map[string]uint64, len(names))
+		}
+		for k, v := range names {
+			s.Groups[g][k] += v
+		}
+	}
+}
+
+// valueSelection says for which names to collect values. A nil selection
+// selects nothing.
+type valueSelection struct {
+	all   bool
+	names map[string]bool
+}
+
+// parseValueSelection parses the argument of -values: empty for nothing,
+// "all" for all names, or a comma-separated list of names.
+func parseValueSelection(arg string) *valueSelection {
+	if arg == "" {
+		return nil
+	}
+	if arg == "all" {
+		return &valueSelection{all: true}
+	}
+
+	ret := &valueSelection{names: make(map[string]bool)}
+	for _, n := range strings.Split(arg, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			ret.names[n] = true
+		}
 	}
+	return ret
+}
+
+func (vs *valueSelection) selected(name string) bool {
+	return vs != nil && (vs.all || vs.names[name])
 }
 
 var (
-	nWorkers = flag.Int("workers", 1, "number of workers in pool")
+	nWorkers  = flag.Int("workers", 1, "number of workers in pool")
+	format    = flag.String("format", formatTable, "output format: table, json, or csv")
+	values    = flag.String("values", "", "collect the most frequent new values of these names (comma-separated, or \"all\")")
+	topN      = flag.Int("top", 10, "number of values per name to report with -values")
+	check     = flag.Bool("check", false, "report names the normalizer has no decision for, and fail if there are any")
+	positions = flag.Bool("positions", false, "report where on the path changes are first observed")
+	kinds     = flag.Bool("kinds", false, "also count modifications, additions, and deletions in the table")
+	groupBy   = flag.String("group-by", "", "count per vantage, port, dst-prefix, or file, and write a matrix")
+	cacheDir  = flag.String("cache", "", "keep the counts of each file in this directory and reuse them")
+	validate  = flag.Bool("validate", false, "count records that fail the checks of the tracebox package as bad")
+	rebuild   = flag.Bool("rebuild-cache", false, "ignore cached counts, and replace them with new ones")
 )
 
+// valueNames are the names selected with -values.
+var valueNames *valueSelection
+
+// progress is where progress reports go.
+var progress io.Writer = os.Stdout
+
 var conditions = newStats()
 
 type job struct {
 	Path string
 }
 
-var ipTCPRe = regexp.MustCompile(`(IP|TCP)::[^"]+`)
+// maxLineLength is the longest line we read from a compressed file.
+const maxLineLength = 16 * 1024 * 1024
 
-// findName finds a name enclosed in "" and containing a double
-// double-colon. Examples: "IP::TTL", "IP::Checksum", "TCP::O::SACKPermitted".
-func findNextName(b []byte) (int, []byte) {
-	i := bytes.Index(b, []byte("::"))
-
-	if i == -1 {
-		return -1, nil
+// checkRecord returns an error if t can't be counted. With -validate, that
+// includes traces that fail the checks of the tracebox package.
+func checkRecord(t *tracebox.Trace) error {
+	if *validate {
+		return t.Validate()
 	}
+	return t.CheckHops()
+}
 
-	start := i
-	for start >= 0 && b[start] != '"' {
-		start--
+// countRecord counts the names in the changes of the tracebox record in
+// line. Lines that aren't records, such as empty lines, are ignored.
+func countRecord(line []byte, stat *stats) {
+	line = trace.TrimSpace(line)
+	if len(line) == 0 || line[0] != '{' {
+		return
 	}
 
-	if start < 0 {
-		return -1, nil
+	var t tracebox.Trace
+	if err := tracebox.Unmarshal(line, &t); err != nil {
+		stat.BadRecords++
+		return
 	}
+	if err := checkRecord(&t); err != nil {
+		stat.BadRecords++
+		return
+	}
+	stat.Records++
 
-	end := i
-	for end < len(b) && b[end] != '"' {
-		end++
+	if *positions {
+		stat.addPositions(&t)
 	}
 
-	if end >= len(b) {
-		return -1, nil
+	group := recordGroup(&t, stat.group)
+
+	for _, h := range t.Hops {
+		for _, nv := range h.Modifications {
+			c := stat.condition(nv.Name)
+			c.Count++
+			c.Modified++
+			stat.addValue(nv.Name, nv.Value)
+			stat.addGroup(group, nv.Name)
+		}
+		for _, nv := range h.Additions {
+			c := stat.condition(nv.Name)
+			c.Count++
+			c.Added++
+			stat.addValue(nv.Name, nv.Value)
+			stat.addGroup(group, nv.Name)
+		}
+		for _, nv := range h.Deletions {
+			c := stat.condition(nv.Name)
+			c.Count++
+			c.Removed++
+			stat.addGroup(group, nv.Name)
+		}
 	}
+}
 
-	return end + 1, b[start+1 : end]
+// countRecords counts the names in all records in region.
+func countRecords(region []byte, stat *stats) {
+	for len(region) > 0 {
+		end := bytes.IndexByte(region, '\n')
+		if end < 0 {
+			end = len(region)
+		}
+		countRecord(region[:end], stat)
+		if end < len(region) {
+			end++
+		}
+		region = region[end:]
+	}
 }
 
-func processFile(path string, stats chan<- stats) {
+// processMapped counts the names in f by mapping it into memory.
+func processMapped(path string, f *os.File) (*stats, error) {
 	var stat = newStats()
-
-	f, err := os.Open(path)
-	if err != nil {
-		log.Printf("ERROR: can't open \"%s\": %v", path, err)
-		return
-	}
+	stat.group = fileGroup(path, *groupBy)
 
 	bytes, size, err := pto3.MapFile(f)
 	if err != nil {
-		log.Printf("ERROR: can't map file \"%s\": %v", path, err)
-		return
+		return nil, fmt.Errorf("can't map file: %v", err)
 	}
 	stat.BytesProcessed = uint64(size)
 
-	region := bytes
-	for end, match := findNextName(region); match != nil; end, match = findNextName(region) {
-		matchs := string(match)
-		if stat.Conditions[matchs] == nil {
-			stat.Conditions[matchs] = new(tbStat)
-		}
-		stat.Conditions[matchs].Count++
-		region = region[end:]
-	}
-
-	stats <- *stat
+	countRecords(bytes, stat)
 
 	if err := pto3.UnmapFile(bytes); err != nil {
 		log.Printf("ERROR: can't unmap \"%s\": %v", path, err)
 	}
-	if err := f.Close(); err != nil {
-		log.Printf("ERROR: can't close \"%s\": %v", path, err)
-	}
+
+	return stat, nil
 }
 
-func worker(id int, jobs <-chan job, wstats chan<- stats, done chan<- bool) {
-	for job := range jobs {
-		processFile(job.Path, wstats)
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+// processStream counts the names in the compressed file f line by line.
+// We can't map a compressed file, and decompressing all of it into memory
+// could take more memory than we have. As for mapped files, the bytes
+// processed are those of the file, not of the decompressed records.
+func processStream(path string, f *os.File) (*stats, error) {
+	var stat = newStats()
+	stat.group = fileGroup(path, *groupBy)
+
+	cf := &countingReader{r: f}
+	in, err := trace.Decompress(cf)
+	if err != nil {
+		return nil, fmt.Errorf("can't decompress: %v", err)
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, maxLineLength)
+	for scanner.Scan() {
+		countRecord(scanner.Bytes(), stat)
 	}
-	done <- true
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read: %v", err)
+	}
+	stat.BytesProcessed = cf.n
+
+	return stat, nil
 }
 
-func processStats(n uint, wstats <-chan stats, quit <-chan bool, statc chan<- stats) {
-	var conditions = newStats()
-	conditions.FilesTotal = n
+// processFile counts the names in the file at path, or takes the counts
+// from the cache if they are there.
+func processFile(path string) (*stats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open: %v", err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Printf("ERROR: can't close \"%s\": %v", path, err)
+		}
+	}()
 
-	for {
-		select {
-		case stat := <-wstats:
-			for k, v := range stat.Conditions {
-				if conditions.Conditions[k] == nil {
-					conditions.Conditions[k] = new(tbStat)
-				}
-				conditions.Conditions[k].Count += v.Count
-			}
-			conditions.FilesProcessed++
-			conditions.BytesProcessed += stat.BytesProcessed
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("can't stat: %v", err)
+	}
 
-		case statc <- *conditions:
+	if stat := cache.load(path, fi); stat != nil {
+		return stat, nil
+	}
 
-		case <-quit:
-			break
+	var stat *stats
+	head := make([]byte, trace.MagicLength)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("can't read: %v", err)
+	} else if trace.Compression(head[:n]) != trace.CompressionNone {
+		stat, err = processStream(path, f)
+	} else {
+		stat, err = processMapped(path, f)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cache.store(path, fi, stat)
+	return stat, nil
+}
+
+// result is what a worker found in one file: its counts, or why there
+// aren't any.
+type result struct {
+	path string
+	stat *stats
+	err  error
+}
+
+// worker processes the files in jobs until there are no more or ctx is
+// done.
+func worker(ctx context.Context, process func(string) (*stats, error), jobs <-chan job, results chan<- result) {
+	for job := range jobs {
+		if ctx.Err() != nil {
+			return
+		}
+		stat, err := process(job.Path)
+		select {
+		case results <- result{path: job.Path, stat: stat, err: err}:
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func fillJobs(paths []string, jobs chan<- job) {
+func fillJobs(ctx context.Context, paths []string, jobs chan<- job) {
+	defer close(jobs)
 	for _, p := range paths {
-		jobs <- job{Path: p}
+		select {
+		case jobs <- job{Path: p}:
+		case <-ctx.Done():
+			return
+		}
 	}
-	close(jobs)
 }
 
-func processFiles(paths []string) *stats {
-	jobs := make(chan job, 2*(*nWorkers))
-	done := make(chan bool, *nWorkers)
-	workerStats := make(chan stats, 2*(*nWorkers))
-	accumulatedStats := make(chan stats)
-	squit := make(chan bool)
+// processFiles counts the names in all files in paths with a pool of
+// workers that call process for each file, and merges their counts. A
+// file that can't be processed is counted as failed. If ctx is done before
+// all files are processed, processFiles returns what it has so far and
+// marks it as interrupted; workers still busy with a file stop when they
+// are done with it.
+func processFiles(ctx context.Context, paths []string, process func(string) (*stats, error)) *stats {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	go processStats(uint(len(paths)), workerStats, squit, accumulatedStats)
+	jobs := make(chan job, 2*(*nWorkers))
+	results := make(chan result, 2*(*nWorkers))
 
-	go fillJobs(paths, jobs)
+	go fillJobs(ctx, paths, jobs)
 
+	var wg sync.WaitGroup
 	for w := 1; w <= *nWorkers; w++ {
-		go worker(w, jobs, workerStats, done)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker(ctx, process, jobs, results)
+		}()
 	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
-	const delay = 1
-	ticker := time.Tick(delay * time.Second)
-	workersDone := false
 	var ret = newStats()
-	var elapsed time.Duration
+	ret.FilesTotal = uint(len(paths))
+	start := time.Now()
 
-	for !workersDone {
+	for {
 		select {
-		case <-ticker:
-			elapsed += delay * time.Second
-			*ret = <-accumulatedStats
-			ret.TimeElapsed = elapsed
-			workersDone = ret.FilesProcessed == ret.FilesTotal
+		case r, ok := <-results:
+			if !ok {
+				ret.TimeElapsed = time.Since(start)
+				printProgress(ret)
+				fmt.Fprintln(progress)
+				return ret
+			}
+			if r.err != nil {
+				log.Printf("ERROR: \"%s\": %v", r.path, r.err)
+				ret.FilesProcessed++
+				ret.FilesFailed++
+			} else {
+				ret.merge(r.stat)
+			}
 
+		case <-ticker.C:
+			ret.TimeElapsed = time.Since(start)
 			printProgress(ret)
-		}
-	}
-	fmt.Println()
 
-	for w := 1; w <= *nWorkers; w++ {
-		<-done
+		case <-ctx.Done():
+			ret.TimeElapsed = time.Since(start)
+			ret.Interrupted = true
+			fmt.Fprintln(progress)
+			return ret
+		}
 	}
-
-	return ret
 }
 
 func printProgress(s *stats) {
 	frac := float64(s.FilesProcessed) / float64(s.FilesTotal)
-	fmt.Printf("\r\x1b[2K%d/%d = %.2f%% done, elapsed = %s, ETA = %s, %s, %s",
+	fmt.Fprintf(progress, "\r\x1b[2K%d/%d = %.2f%% done, elapsed = %s, ETA = %s, %s, %s",
 		s.FilesProcessed, s.FilesTotal,
 		100.0*frac, s.TimeElapsed,
 		time.Duration(math.Round((1.0-frac)*float64(s.TimeElapsed)/frac)),
@@ -225,7 +501,7 @@ func unit(size float64) sizeUnit {
 }
 
 func throughputString(bytes uint64, elapsed time.Duration) string {
-	throughput := float64(bytes) / float64(elapsed/time.Second)
+	throughput := float64(bytes) / elapsed.Seconds()
 	u := unit(throughput)
 
 	return fmt.Sprintf("%.2f %s/s", throughput/u.Factor, u.Name)
@@ -237,32 +513,79 @@ func sizeString(bytes uint64) string {
 	return fmt.Sprintf("%.2f %s", float64(bytes)/u.Factor, u.Name)
 }
 
-func keys(conditions map[string]*tbStat) []string {
-	keys := make([]string, len(conditions))
+func main() {
+	flag.Parse()
+
+	if !validFormat(*format) {
+		log.Fatalf("unknown format %s", *format)
+	}
 
-	i := 0
-	for k := range conditions {
-		keys[i] = k
-		i++
+	if *topN < 1 {
+		log.Fatalf("-top must be at least 1")
 	}
-	return keys
-}
+	valueNames = parseValueSelection(*values)
 
-func printMap(conditions map[string]*tbStat) {
-	ckeys := keys(conditions)
+	if !validGroupBy(*groupBy) {
+		log.Fatalf("unknown -group-by %s", *groupBy)
+	}
 
-	sort.Slice(ckeys, func(i, j int) bool {
-		return conditions[ckeys[i]].Count > conditions[ckeys[j]].Count
-	})
+	if *cacheDir != "" {
+		if err := os.MkdirAll(*cacheDir, 0755); err != nil {
+			log.Fatalf("can't create cache directory: %v", err)
+		}
+		cache = &fileCache{dir: *cacheDir, rebuild: *rebuild}
+	} else if *rebuild {
+		log.Fatalf("-rebuild-cache needs -cache")
+	}
 
-	for _, k := range ckeys {
-		fmt.Printf("%12d %s\n", conditions[k].Count, k)
+	// Keep stdout clean for scripts.
+	if *format != formatTable || *check {
+		progress = os.Stderr
 	}
-}
 
-func main() {
-	flag.Parse()
-	s := processFiles(flag.Args())
-	fmt.Println(s.FilesProcessed, "files in", s.TimeElapsed, "seconds")
-	printMap(s.Conditions)
+	// Stop on the first SIGINT and write what we have; a second one kills
+	// us.
+	ctx, cancel := context.WithCancel(context.Background())
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	go func() {
+		<-sigc
+		signal.Stop(sigc)
+		cancel()
+	}()
+
+	s := processFiles(ctx, flag.Args(), processFile)
+	fmt.Fprintln(progress, s.FilesProcessed, "files in", s.TimeElapsed)
+	if s.FilesFailed > 0 {
+		fmt.Fprintln(progress, s.FilesFailed, "files failed")
+	}
+	if cache != nil {
+		fmt.Fprintln(progress, s.FilesCached, "files from cache")
+	}
+	if s.Interrupted {
+		fmt.Fprintln(progress, "interrupted, counts are partial")
+	}
+
+	if *check {
+		unchecked := checkNames(s)
+		if err := writeCheck(os.Stdout, unchecked, *format); err != nil {
+			log.Fatalf("can't write output: %v", err)
+		}
+		if len(unchecked) > 0 {
+			os.Exit(1)
+		}
+	} else {
+		write := writeStats
+		if *groupBy != "" {
+			write = writeMatrix
+		}
+		if err := write(os.Stdout, s, *format); err != nil {
+			log.Fatalf("can't write output: %v", err)
+		}
+	}
+
+	// Don't let scripts mistake partial counts for complete ones.
+	if s.Interrupted {
+		os.Exit(130)
+	}
 }
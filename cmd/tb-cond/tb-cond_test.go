@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestProcessStreamBytes(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(bytes.Repeat([]byte(mssRecord), 100))
+	w.Close()
+
+	f, err := ioutil.TempFile("", "tb-cond")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(gz.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := processStream(f.Name(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bytes of the file, like for mapped files, not of the records.
+	if s.BytesProcessed != uint64(gz.Len()) {
+		t.Errorf("want %d bytes processed, got %d", gz.Len(), s.BytesProcessed)
+	}
+	if c := s.Conditions["TCP::O::MSS"]; c == nil || c.Count != 100 {
+		t.Errorf("bad MSS count %+v", c)
+	}
+}
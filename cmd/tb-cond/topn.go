@@ -0,0 +1,175 @@
+// Copyright 2018 Zurich University of Applied Sciences.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// sketchFactor is how many more counters a sketch keeps than values we
+// report. More counters make the counts of the reported values more
+// accurate.
+const sketchFactor = 10
+
+// ssCounter is the counter of one value in a spaceSaving sketch. The true
+// count of the value is between Count-Err and Count.
+type ssCounter struct {
+	Value string
+	Count uint64
+	Err   uint64
+	index int // in the heap
+}
+
+// ssHeap is a min-heap of counters by count.
+type ssHeap []*ssCounter
+
+func (h ssHeap) Len() int           { return len(h) }
+func (h ssHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h ssHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *ssHeap) Push(x interface{}) {
+	c := x.(*ssCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *ssHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// spaceSaving finds the most frequent values in a stream with a fixed
+// number of counters, using the Space-Saving algorithm of Metwally et al.,
+// "Efficient Computation of Frequent and Top-k Elements in Data Streams".
+// A value that isn't counted yet takes over the counter with the smallest
+// count once all counters are in use. Every value that occurs more often
+// than the total divided by the number of counters is guaranteed to be
+// counted. Memory doesn't depend on how many distinct values there are,
+// which for fields like IP::ID is a lot.
+type spaceSaving struct {
+	k        int
+	counters map[string]*ssCounter
+	heap     ssHeap
+}
+
+func newSpaceSaving(k int) *spaceSaving {
+	return &spaceSaving{
+		k:        k,
+		counters: make(map[string]*ssCounter, k),
+		heap:     make(ssHeap, 0, k),
+	}
+}
+
+// add counts n occurrences of v.
+func (s *spaceSaving) add(v string, n uint64) {
+	if c, ok := s.counters[v]; ok {
+		c.Count += n
+		heap.Fix(&s.heap, c.index)
+		return
+	}
+
+	if len(s.heap) < s.k {
+		c := &ssCounter{Value: v, Count: n}
+		s.counters[v] = c
+		heap.Push(&s.heap, c)
+		return
+	}
+
+	// Take over the counter with the smallest count.
+	c := s.heap[0]
+	delete(s.counters, c.Value)
+	c.Value = v
+	c.Err = c.Count
+	c.Count += n
+	s.counters[v] = c
+	heap.Fix(&s.heap, 0)
+}
+
+// min returns the smallest count if all counters are in use, and zero
+// otherwise. A value that isn't counted occurred at most this often.
+func (s *spaceSaving) min() uint64 {
+	if len(s.heap) < s.k {
+		return 0
+	}
+	return s.heap[0].Count
+}
+
+// merge adds the counts of o to s, as described by Agarwal et al.,
+// "Mergeable Summaries": a value missing from one sketch is assumed to
+// have occurred as often as that sketch's smallest count, and of the
+// combined counters, the k largest are kept.
+func (s *spaceSaving) merge(o *spaceSaving) {
+	smin, omin := s.min(), o.min()
+
+	combined := make(map[string]*ssCounter, len(s.counters)+len(o.counters))
+	for v, c := range s.counters {
+		combined[v] = &ssCounter{Value: v, Count: c.Count, Err: c.Err}
+	}
+	for v, c := range o.counters {
+		if m, ok := combined[v]; ok {
+			m.Count += c.Count
+			m.Err += c.Err
+		} else {
+			combined[v] = &ssCounter{Value: v, Count: c.Count + smin, Err: c.Err + smin}
+		}
+	}
+	for v, c := range combined {
+		if _, ok := o.counters[v]; !ok {
+			c.Count += omin
+			c.Err += omin
+		}
+	}
+
+	all := make([]*ssCounter, 0, len(combined))
+	for _, c := range combined {
+		all = append(all, c)
+	}
+	sortCounters(all)
+	if len(all) > s.k {
+		all = all[:s.k]
+	}
+
+	s.counters = make(map[string]*ssCounter, s.k)
+	s.heap = make(ssHeap, 0, s.k)
+	for _, c := range all {
+		s.counters[c.Value] = c
+		heap.Push(&s.heap, c)
+	}
+}
+
+// top returns the n values with the largest counts, largest first.
+func (s *spaceSaving) top(n int) []ssCounter {
+	all := make([]*ssCounter, 0, len(s.heap))
+	all = append(all, s.heap...)
+	sortCounters(all)
+
+	if len(all) > n {
+		all = all[:n]
+	}
+
+	ret := make([]ssCounter, len(all))
+	for i, c := range all {
+		ret[i] = *c
+	}
+	return ret
+}
+
+// sortCounters sorts counters by count, largest first, and by value for
+// equal counts so that the output is stable.
+func sortCounters(cs []*ssCounter) {
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].Count != cs[j].Count {
+			return cs[i].Count > cs[j].Count
+		}
+		return cs[i].Value < cs[j].Value
+	})
+}
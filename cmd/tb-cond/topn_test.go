@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestSpaceSavingExact(t *testing.T) {
+	s := newSpaceSaving(10)
+	for i := 0; i < 5; i++ {
+		for j := 0; j <= i; j++ {
+			s.add(strconv.Itoa(i), 1)
+		}
+	}
+
+	top := s.top(2)
+	if len(top) != 2 || top[0].Value != "4" || top[0].Count != 5 || top[1].Value != "3" || top[1].Count != 4 {
+		t.Errorf("bad top values %+v", top)
+	}
+	if top[0].Err != 0 {
+		t.Errorf("counts must be exact while there are free counters, got error %d", top[0].Err)
+	}
+}
+
+func TestSpaceSavingHeavyHitters(t *testing.T) {
+	// Two frequent values in a stream of 10000 distinct ones, with only
+	// 20 counters.
+	s := newSpaceSaving(20)
+	for i := 0; i < 10000; i++ {
+		s.add("x"+strconv.Itoa(i), 1)
+		if i%4 == 0 {
+			s.add("0564", 1)
+		}
+		if i%10 == 0 {
+			s.add("05b4", 1)
+		}
+	}
+
+	top := s.top(2)
+	if len(top) != 2 || top[0].Value != "0564" || top[1].Value != "05b4" {
+		t.Fatalf("heavy hitters not found: %+v", top)
+	}
+	for _, c := range top {
+		want := map[string]uint64{"0564": 2500, "05b4": 1000}[c.Value]
+		if c.Count < want || c.Count-c.Err > want {
+			t.Errorf("%s: true count %d not in [%d, %d]", c.Value, want, c.Count-c.Err, c.Count)
+		}
+	}
+	if len(s.counters) != 20 || len(s.heap) != 20 {
+		t.Errorf("sketch grew to %d counters", len(s.counters))
+	}
+}
+
+func TestSpaceSavingMerge(t *testing.T) {
+	a := newSpaceSaving(3)
+	b := newSpaceSaving(3)
+
+	a.add("00", 10)
+	a.add("08", 5)
+	b.add("00", 7)
+	b.add("2e", 6)
+
+	a.merge(b)
+
+	top := a.top(3)
+	if len(top) != 3 || top[0].Value != "00" || top[0].Count != 17 || top[1].Value != "2e" || top[2].Value != "08" {
+		t.Errorf("bad merged values %+v", top)
+	}
+
+	// Merging into a full sketch keeps it bounded.
+	c := newSpaceSaving(3)
+	c.add("01", 1)
+	c.add("02", 1)
+	c.add("03", 1)
+	a.merge(c)
+	if len(a.counters) != 3 || len(a.heap) != 3 {
+		t.Errorf("merged sketch has %d counters", len(a.counters))
+	}
+	if top := a.top(1); top[0].Value != "00" {
+		t.Errorf("bad top value after merge %+v", top)
+	}
+}
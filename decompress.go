@@ -0,0 +1,75 @@
+package pto3trace
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression formats that Decompress recognizes, by their magic bytes.
+const (
+	CompressionNone  = ""
+	CompressionGzip  = "gzip"
+	CompressionBzip2 = "bzip2"
+	CompressionXz    = "xz"
+	CompressionZstd  = "zstd"
+)
+
+var compressionMagic = []struct {
+	name  string
+	magic []byte
+}{
+	{CompressionGzip, []byte{0x1f, 0x8b}},
+	{CompressionBzip2, []byte("BZh")},
+	{CompressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// MagicLength is how many bytes from the start of a file Compression needs
+// to see.
+const MagicLength = 6
+
+// Compression returns the compression format of a file that starts with
+// head, or CompressionNone if it isn't compressed in a format we know.
+// We go by the magic bytes, not the file name, since raw files in the PTO
+// don't keep their names.
+func Compression(head []byte) string {
+	for _, cm := range compressionMagic {
+		if bytes.HasPrefix(head, cm.magic) {
+			return cm.name
+		}
+	}
+	return CompressionNone
+}
+
+// Decompress returns a reader with the decompressed contents of in if in is
+// compressed with gzip, bzip2, xz, or zstd, and a reader with the contents
+// of in otherwise.
+func Decompress(in io.Reader) (io.Reader, error) {
+	bin := bufio.NewReader(in)
+
+	head, err := bin.Peek(MagicLength)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch Compression(head) {
+	case CompressionGzip:
+		return gzip.NewReader(bin)
+	case CompressionBzip2:
+		return bzip2.NewReader(bin), nil
+	case CompressionXz:
+		return xz.NewReader(bin)
+	case CompressionZstd:
+		// With a concurrency of 1, the decoder doesn't start goroutines
+		// for streams, so there's nothing to close.
+		return zstd.NewReader(bin, zstd.WithDecoderConcurrency(1))
+	default:
+		return bin, nil
+	}
+}
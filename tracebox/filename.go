@@ -0,0 +1,53 @@
+// Copyright 2018 Zurich University of Applied Sciences.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package tracebox
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// FileName is what the name of a tracebox campaign file says about it.
+// Such names have the form <port>-<num>-<src_ip>.json, possibly followed
+// by a suffix for compression, like 80-1-128.10.18.52.json.gz.
+type FileName struct {
+	Port   int    // the TCP destination port of the probes
+	Num    int    // the number of the file
+	Source net.IP // the vantage point, i.e., where the probes were sent from
+}
+
+// The source address is either an IPv4 address in dotted-quad notation or
+// an IPv6 address in any textual form; net.ParseIP sorts out which. The
+// only suffixes allowed after .json are those of the compressors that
+// Decompress understands.
+var fileNameRe = regexp.MustCompile(`^(\d+)-(\d+)-([0-9A-Fa-f:.]+)\.json(\.(gz|bz2|xz|zst))?$`)
+
+// ParseFileName parses the name of the tracebox campaign file at path.
+func ParseFileName(path string) (*FileName, error) {
+	matches := fileNameRe.FindStringSubmatch(filepath.Base(path))
+	if matches == nil {
+		return nil, errors.New("file name does not have expected form")
+	}
+
+	port, err := strconv.Atoi(matches[1])
+	if err != nil || port > 65535 {
+		return nil, errors.New("file name does not contain a valid port")
+	}
+
+	num, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return nil, errors.New("file name does not contain a valid number")
+	}
+
+	ip := net.ParseIP(matches[3])
+	if ip == nil {
+		return nil, errors.New("file name does not contain a valid IP address")
+	}
+
+	return &FileName{Port: port, Num: num, Source: ip}, nil
+}
@@ -0,0 +1,28 @@
+package tracebox
+
+import "testing"
+
+func TestParseFileName(t *testing.T) {
+	fn, err := ParseFileName("/data/campaign/80-3-128.10.18.52.json.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fn.Port != 80 || fn.Num != 3 || fn.Source.String() != "128.10.18.52" {
+		t.Errorf("bad file name %+v", fn)
+	}
+
+	fn, err = ParseFileName("443-1-2001:DB8:0::1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fn.Port != 443 || fn.Source.String() != "2001:db8::1" {
+		t.Errorf("bad file name %+v", fn)
+	}
+
+	for _, bad := range []string{"trace.json", "80-1-300.1.1.1.json", "99999-1-10.0.0.1.json",
+		"old-80-1-10.0.0.1.json", "80-1-10.0.0.1.json.bak", "80-1-10.0.0.1.jsonl"} {
+		if _, err := ParseFileName(bad); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
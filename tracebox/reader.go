@@ -0,0 +1,103 @@
+// Copyright 2018 Zurich University of Applied Sciences.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package tracebox
+
+import (
+	"bufio"
+	"io"
+
+	trace "github.com/mami-project/pto3-trace"
+)
+
+// maxLineLength is the longest line a Reader accepts. Traces with many hops
+// are well beyond bufio.Scanner's default of 64 KiB.
+const maxLineLength = 16 * 1024 * 1024
+
+// Reader reads traces from a tracebox NDJSON file, one per line. Compressed
+// input (gzip, bzip2, xz, or zstd) is detected and decompressed
+// transparently. Lines that don't start with "{", such as empty lines, are
+// skipped.
+//
+// Use it like a bufio.Scanner:
+//
+//	r, err := tracebox.NewReader(in)
+//	...
+//	for r.Next() {
+//		var t tracebox.Trace
+//		if err := r.Decode(&t); err != nil {
+//			log.Printf("line %d: %v", r.Line(), err)
+//			continue
+//		}
+//		...
+//	}
+//	if err := r.Err(); err != nil {
+//		...
+//	}
+type Reader struct {
+	scanner *bufio.Scanner
+	rec     []byte
+	line    int
+	skipped int
+}
+
+// NewReader returns a Reader that reads from in.
+func NewReader(in io.Reader) (*Reader, error) {
+	din, err := trace.Decompress(in)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(din)
+	scanner.Buffer(nil, maxLineLength)
+
+	return &Reader{scanner: scanner}, nil
+}
+
+// Next advances to the next record. It returns false at the end of the
+// input or on an error, in which case Err returns the error.
+func (r *Reader) Next() bool {
+	for r.scanner.Scan() {
+		r.line++
+		rec := trace.TrimSpace(r.scanner.Bytes())
+
+		if len(rec) == 0 || rec[0] != '{' {
+			r.skipped++
+			continue
+		}
+
+		r.rec = rec
+		return true
+	}
+
+	r.rec = nil
+	return false
+}
+
+// Decode decodes the current record into t.
+func (r *Reader) Decode(t *Trace) error {
+	return Unmarshal(r.rec, t)
+}
+
+// Bytes returns the current record. The underlying array may be overwritten
+// by the next call to Next.
+func (r *Reader) Bytes() []byte {
+	return r.rec
+}
+
+// Line returns the line number of the current record.
+func (r *Reader) Line() int {
+	return r.line
+}
+
+// Skipped returns the number of lines skipped so far because they weren't
+// records.
+func (r *Reader) Skipped() int {
+	return r.skipped
+}
+
+// Err returns the first error that happened while reading, if any.
+func (r *Reader) Err() error {
+	return r.scanner.Err()
+}
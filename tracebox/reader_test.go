@@ -0,0 +1,165 @@
+package tracebox
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const twoTraces = `{"dst":"88.212.202.2", "r":"tcp-rst", "s":1462315337, "h":[{"ha":"128.112.139.1", "t":1, "i":2, "m":[], "a":[], "d":[]}, {"ha":"128.112.12.57", "t":2, "i":2, "m":[{"n":"TCP::O::MSS", "v":"0564"}], "a":[], "d":[]}]}
+
+# not a record
+{"dst":"2001:db8::2", "r":"tcp-rst", "s":1462315338, "h":[]}
+`
+
+func readAll(t *testing.T, r *Reader) []Trace {
+	var ret []Trace
+
+	for r.Next() {
+		var tr Trace
+		if err := r.Decode(&tr); err != nil {
+			t.Fatalf("line %d: %v", r.Line(), err)
+		}
+		ret = append(ret, tr)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return ret
+}
+
+func TestReader(t *testing.T) {
+	r, err := NewReader(strings.NewReader(twoTraces))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traces := readAll(t, r)
+	if len(traces) != 2 {
+		t.Fatalf("want 2 traces, got %d", len(traces))
+	}
+	if r.Line() != 4 || r.Skipped() != 2 {
+		t.Errorf("want 4 lines and 2 skipped, got %d and %d", r.Line(), r.Skipped())
+	}
+	if traces[0].Hops[1].Modifications[0].Name != "TCP::O::MSS" || traces[1].Timestamp != 1462315338 {
+		t.Errorf("unexpected traces %+v", traces)
+	}
+}
+
+func TestCompressedReader(t *testing.T) {
+	compressors := map[string]func(io.Writer) (io.WriteCloser, error){
+		"gzip": func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		"xz":   func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) },
+		"zstd": func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+	}
+
+	for name, compressor := range compressors {
+		var b bytes.Buffer
+		w, err := compressor(&b)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		w.Write([]byte(twoTraces))
+		w.Close()
+
+		r, err := NewReader(&b)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if traces := readAll(t, r); len(traces) != 2 {
+			t.Errorf("%s: want 2 traces, got %d", name, len(traces))
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	r, _ := NewReader(strings.NewReader(twoTraces))
+	for _, tr := range readAll(t, r) {
+		if err := tr.Validate(); err != nil {
+			t.Errorf("valid trace fails validation: %v", err)
+		}
+	}
+
+	bad := []string{
+		`{"dst":"foo", "s":1, "h":[]}`,
+		`{"dst":"88.212.202.2", "s":1, "h":[{"ha":"bar", "t":1}]}`,
+		`{"dst":"88.212.202.2", "s":1, "h":[{"ha":"*", "t":2}, {"ha":"*", "t":2}]}`,
+		`{"dst":"88.212.202.2", "s":1, "h":[{"ha":"*", "t":1, "m":[{"n":"MSS", "v":"1"}]}]}`,
+		`{"dst":"88.212.202.2", "s":1, "h":[{"ha":"*", "t":256}]}`,
+	}
+	for _, b := range bad {
+		var tr Trace
+		if err := Unmarshal([]byte(b), &tr); err != nil {
+			t.Fatal(err)
+		}
+		if tr.Validate() == nil {
+			t.Errorf("invalid trace %s passes validation", b)
+		}
+	}
+}
+
+func TestCheckHops(t *testing.T) {
+	// Only what can't be read at all fails; the rest is for Validate.
+	good := `{"dst":"foo", "s":1, "h":[{"ha":"bar", "t":2}, {"ha":"*", "t":1, "m":[{"n":"MSS", "v":"1"}]}]}`
+	bad := []string{
+		`{"dst":"88.212.202.2", "s":1, "h":[null]}`,
+		`{"dst":"88.212.202.2", "s":1, "h":[{"ha":"*", "t":0}]}`,
+		`{"dst":"88.212.202.2", "s":1, "h":[{"ha":"*", "t":256}]}`,
+	}
+
+	var tr Trace
+	if err := Unmarshal([]byte(good), &tr); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.CheckHops(); err != nil {
+		t.Errorf("usable trace fails hop check: %v", err)
+	}
+
+	for _, b := range bad {
+		var tr Trace
+		if err := Unmarshal([]byte(b), &tr); err != nil {
+			t.Fatal(err)
+		}
+		if tr.CheckHops() == nil {
+			t.Errorf("unusable trace %s passes hop check", b)
+		}
+	}
+}
+
+func TestUnmarshalV2(t *testing.T) {
+	const v2 = `{"dst":"2001:db8::2", "r":"tcp-rst", "s":1462315338, "pt":"ecn-setup", "p":[{"n":"IPv6::TrafficClass", "v":"00"}, {"n":"TCP::Flags", "v":"c2"}], "h":[{"ha":"2001:db8::1", "t":1, "i":2, "m":[], "a":[], "d":[]}]}`
+
+	var tr TraceV2
+	if err := UnmarshalV2([]byte(v2), &tr); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Dst != "2001:db8::2" || len(tr.Hops) != 1 || tr.ProbeType != ProbeECNSetup || tr.Probe[1].Value != "c2" {
+		t.Errorf("unexpected v2 trace %+v", tr)
+	}
+	if err := tr.Validate(); err != nil {
+		t.Errorf("valid trace fails validation: %v", err)
+	}
+
+	tr.ProbeType = "fin"
+	if tr.Validate() == nil {
+		t.Errorf("unknown probe type passes validation")
+	}
+}
+
+func TestSameAddress(t *testing.T) {
+	if !SameAddress("2001:db8::1", "2001:0db8:0:0::1") {
+		t.Errorf("different forms of an IPv6 address should be the same")
+	}
+	if !SameAddress("*", "*") || SameAddress("*", "192.0.2.1") {
+		t.Errorf("non-addresses should be compared literally")
+	}
+	if SameAddress("192.0.2.1", "192.0.2.2") {
+		t.Errorf("different addresses should not be the same")
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 Zurich University of Applied Sciences.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+// Package tracebox reads tracebox NDJSON files.
+//
+// Each line in a tracebox NDJSON file is one trace, i.e., the result of sending probes
+// with increasing TTL towards one destination. For every hop, tracebox
+// records which header fields were modified, added, or deleted compared to
+// the probe that was sent. Header fields have names like IP::TTL or
+// TCP::O::MSS.
+package tracebox
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/json-iterator/go"
+)
+
+// NameValue is a header field and its value as seen at a hop.
+type NameValue struct {
+	Name  string `json:"n"`
+	Value string `json:"v"`
+}
+
+// Hop is one hop of a trace. Address is "*" if the hop didn't respond.
+//
+// ICMPQuotation is tracebox's class of the ICMP quotation the hop sent. The
+// records in the original test data only have 0, 2, and 3, and 0 only for
+// the destination, so it's not a length, but what the other classes mean
+// isn't known.
+type Hop struct {
+	Address       string      `json:"ha"`
+	TTL           int         `json:"t"`
+	ICMPQuotation int         `json:"i"`
+	Modifications []NameValue `json:"m"`
+	Additions     []NameValue `json:"a"`
+	Deletions     []NameValue `json:"d"`
+}
+
+// Trace is one line in a tracebox NDJSON file.
+type Trace struct {
+	Dst       string `json:"dst"`
+	Reason    string `json:"r"`
+	Timestamp int64  `json:"s"`
+	Hops      []*Hop `json:"h"`
+}
+
+// Probe types in tracebox v2 traces.
+const (
+	ProbeSYN      = "syn"       // TCP SYN
+	ProbeData     = "data"      // TCP segment with payload
+	ProbeECNSetup = "ecn-setup" // ECN-setup SYN, i.e., with ECE and CWR set
+)
+
+// TraceV2 is one line in a tracebox v2 (extended) NDJSON file. In addition to
+// what's in a v1 trace, it says what kind of probe was sent and what the
+// header fields of the probe were, so that a change can be reported together
+// with the original value.
+type TraceV2 struct {
+	Trace
+	ProbeType string      `json:"pt"`
+	Probe     []NameValue `json:"p"`
+}
+
+// Unmarshal decodes a single trace.
+func Unmarshal(b []byte, t *Trace) error {
+	return jsoniter.Unmarshal(b, t)
+}
+
+// ValidName returns true if name looks like a tracebox header field name,
+// i.e., a layer such as IP, IPv6, or TCP, followed by "::" and the field.
+func ValidName(name string) bool {
+	i := strings.Index(name, "::")
+	return i > 0 && i+2 < len(name) && !strings.ContainsAny(name, " \t\"")
+}
+
+// ValidAddress returns true if addr is an IPv4 or IPv6 address.
+func ValidAddress(addr string) bool {
+	return net.ParseIP(addr) != nil
+}
+
+// SameAddress returns true if a and b denote the same IP address. IPv6
+// addresses have many textual representations, so comparing strings
+// isn't good enough. Anything that isn't an IP address, such as "*",
+// is compared literally.
+func SameAddress(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	ipa := net.ParseIP(a)
+	ipb := net.ParseIP(b)
+
+	return ipa != nil && ipb != nil && ipa.Equal(ipb)
+}
+
+// MaxTTL is the largest TTL (or IPv6 hop limit) there is.
+const MaxTTL = 255
+
+// CheckHops returns an error if t has hops that can't be used at all, i.e.,
+// hops that are null or whose TTL isn't a valid TTL. Everything else in a
+// trace can be read as it is; Validate checks more.
+func (t *Trace) CheckHops() error {
+	for i, h := range t.Hops {
+		if h == nil {
+			return fmt.Errorf("hop %d: missing", i)
+		}
+		if h.TTL < 1 || h.TTL > MaxTTL {
+			return fmt.Errorf("hop %d: invalid TTL %d", i, h.TTL)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that t is sane: in addition to the checks of CheckHops,
+// the destination and the hop addresses must be IP addresses (or "*" for
+// hops), TTLs must increase, and all field names must be valid tracebox
+// names. Traces that fail these checks can still be read, so whether to
+// reject them is up to the caller.
+func (t *Trace) Validate() error {
+	if err := t.CheckHops(); err != nil {
+		return err
+	}
+
+	if !ValidAddress(t.Dst) {
+		return fmt.Errorf("invalid destination address \"%s\"", t.Dst)
+	}
+
+	ttl := 0
+	for i, h := range t.Hops {
+		if h.Address != "*" && !ValidAddress(h.Address) {
+			return fmt.Errorf("hop %d: invalid address \"%s\"", i, h.Address)
+		}
+		if h.TTL <= ttl {
+			return fmt.Errorf("hop %d: TTL %d doesn't increase", i, h.TTL)
+		}
+		ttl = h.TTL
+
+		for _, nvs := range [][]NameValue{h.Modifications, h.Additions, h.Deletions} {
+			for _, nv := range nvs {
+				if !ValidName(nv.Name) {
+					return fmt.Errorf("hop %d: invalid name \"%s\"", i, nv.Name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// UnmarshalV2 decodes a single v2 trace.
+func UnmarshalV2(b []byte, t *TraceV2) error {
+	return jsoniter.Unmarshal(b, t)
+}
+
+// Validate checks that t is sane. In addition to the checks for v1 traces,
+// the probe type must be known and the probe's field names must be valid.
+func (t *TraceV2) Validate() error {
+	if err := t.Trace.Validate(); err != nil {
+		return err
+	}
+
+	switch t.ProbeType {
+	case ProbeSYN, ProbeData, ProbeECNSetup:
+	default:
+		return fmt.Errorf("unknown probe type \"%s\"", t.ProbeType)
+	}
+
+	for _, nv := range t.Probe {
+		if !ValidName(nv.Name) {
+			return fmt.Errorf("probe: invalid name \"%s\"", nv.Name)
+		}
+	}
+
+	return nil
+}